@@ -0,0 +1,114 @@
+package prometheusmetrics
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+// lockingRegistry holds its lock while iterating, like registries that don't
+// iterate over a copy, and measures how long it's held.
+type lockingRegistry struct {
+	metrics.Registry
+	mutex sync.Mutex
+	held  time.Duration
+}
+
+func (r *lockingRegistry) Each(f func(string, interface{})) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	start := time.Now()
+	r.Registry.Each(f)
+	r.held += time.Since(start)
+}
+
+func (r *lockingRegistry) GetOrRegister(name string, i interface{}) interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.Registry.GetOrRegister(name, i)
+}
+
+func benchmarkRegistry(n int) metrics.Registry {
+	metricsRegistry := metrics.NewRegistry()
+	for i := 0; i < n; i++ {
+		histogram := metrics.NewHistogram(metrics.NewUniformSample(1028))
+		for v := int64(0); v < 1028; v++ {
+			histogram.Update(v)
+		}
+		metricsRegistry.Register(fmt.Sprintf("histogram%d", i), histogram)
+	}
+	return metricsRegistry
+}
+
+func BenchmarkFlushRegistryLockHold(b *testing.B) {
+	for _, snapshot := range []bool{false, true} {
+		b.Run(fmt.Sprintf("snapshot=%v", snapshot), func(b *testing.B) {
+			metricsRegistry := &lockingRegistry{Registry: benchmarkRegistry(100)}
+			pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+				WithRegistrySnapshot(snapshot)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pClient.UpdatePrometheusMetricsOnce()
+			}
+			b.ReportMetric(float64(metricsRegistry.held.Nanoseconds())/float64(b.N), "lock-ns/op")
+		})
+	}
+}
+
+func BenchmarkFlushRegistrySnapshot(b *testing.B) {
+	for _, snapshot := range []bool{false, true} {
+		b.Run(fmt.Sprintf("snapshot=%v", snapshot), func(b *testing.B) {
+			metricsRegistry := metrics.NewRegistry()
+			for i := 0; i < 1000; i++ {
+				metricsRegistry.Register(fmt.Sprintf("gauge%d", i), metrics.NewGauge())
+			}
+			pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+				WithRegistrySnapshot(snapshot)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pClient.UpdatePrometheusMetricsOnce()
+			}
+		})
+	}
+}
+
+func BenchmarkFlushSimple(b *testing.B) {
+	for _, fastPath := range []bool{false, true} {
+		b.Run(fmt.Sprintf("fastPath=%v", fastPath), func(b *testing.B) {
+			metricsRegistry := metrics.NewRegistry()
+			for i := 0; i < 1000; i++ {
+				metricsRegistry.Register(fmt.Sprintf("counter%d", i), metrics.NewCounter())
+				metricsRegistry.Register(fmt.Sprintf("gauge%d", i), metrics.NewGauge())
+			}
+			pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+			pClient.noFastPath = !fastPath
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pClient.UpdatePrometheusMetricsOnce()
+			}
+		})
+	}
+}
+
+func BenchmarkCollectParallel(b *testing.B) {
+	metricsRegistry := metrics.NewRegistry()
+	for i := 0; i < 1000; i++ {
+		metricsRegistry.Register(fmt.Sprintf("gauge%d", i), metrics.NewGauge())
+	}
+	collector := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).Collector()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ch := make(chan prometheus.Metric, 1000)
+		for pb.Next() {
+			collector.Collect(ch)
+			for len(ch) > 0 {
+				<-ch
+			}
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package prometheusmetrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SetBuildInfo exports a constant build_info gauge of value 1, labelled with
+// labels, e.g. the version and commit of the application, alongside the
+// go-metrics. It replaces the gauge of an earlier call and isn't touched by
+// flushes or Reset.
+func (c *PrometheusConfig) SetBuildInfo(labels prometheus.Labels) error {
+	c.flushMutex.Lock()
+	defer c.flushMutex.Unlock()
+	constLabels := c.constLabelsWithout(labels)
+	for name, value := range labels {
+		constLabels[name] = value
+	}
+	buildInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   c.flattenKey(c.namespace),
+		Subsystem:   c.flattenKey(c.subsystem),
+		Name:        "build_info",
+		Help:        "Build information of the application, the value is always 1.",
+		ConstLabels: constLabels,
+	})
+	buildInfo.Set(1)
+	if c.buildInfo != nil {
+		c.unregister(c.buildInfo)
+	}
+	registered, err := c.register(buildInfo)
+	if err != nil {
+		return err
+	}
+	c.buildInfo = registered
+	return nil
+}
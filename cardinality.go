@@ -0,0 +1,129 @@
+package prometheusmetrics
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxRememberedDrops is the most label combinations dropped by the
+// cardinality caps that are remembered, so memory stays bounded however many
+// combinations the go-metrics registry holds.
+const maxRememberedDrops = 10000
+
+// WithMaxSeriesPerMetric caps the number of label combinations exported per
+// metric name at n. Series of further label combinations are dropped, see
+// WithOnCardinalityExceeded. Zero, the default, disables the cap.
+func (c *PrometheusConfig) WithMaxSeriesPerMetric(n int) *PrometheusConfig {
+	c.maxSeriesPerMetric = n
+	return c
+}
+
+// WithMaxSeries caps the number of series the provider exports in total at n,
+// as a last resort against an exploding go-metrics registry, e.g. a bug
+// creating a metric per request. Series beyond the cap are dropped and
+// counted by go_metrics_prometheus_series_dropped_total, see WithSelfMetrics,
+// and WithOnCardinalityExceeded. The first time the cap is hit, an error is
+// passed to the error handler. Series count until Reset, even after their
+// metrics were removed. Zero, the default, disables the cap.
+func (c *PrometheusConfig) WithMaxSeries(n int) *PrometheusConfig {
+	c.maxSeries = n
+	return c
+}
+
+// WithOnCardinalityExceeded sets a function called with the metric name and
+// labels of every label combination dropped because of the caps set by
+// WithMaxSeriesPerMetric and WithMaxSeries. It's called once per dropped
+// combination, the first time it's dropped. Only the first 10000 dropped
+// combinations are remembered until Reset, further ones are dropped without
+// being reported or counted.
+func (c *PrometheusConfig) WithOnCardinalityExceeded(exceeded func(metricName string, droppedLabels prometheus.Labels)) *PrometheusConfig {
+	c.onCardinalityExceeded = exceeded
+	return c
+}
+
+// capped returns w limited to the series admitted by the cardinality caps.
+func (c *PrometheusConfig) capped(w metricWriter) metricWriter {
+	if c.maxSeriesPerMetric <= 0 && c.maxSeries <= 0 {
+		return w
+	}
+	return cappedWriter{w, c}
+}
+
+// admitSeries reports whether the series of name with labels is within the
+// cardinality caps, counting it if it's new.
+func (c *PrometheusConfig) admitSeries(key string, name string, labels prometheus.Labels) bool {
+	signature := labelSignature(labels)
+	var beyond string
+	var capHit bool
+	c.mutex.Lock()
+	series := c.seriesLabels[key]
+	admitted, known := series[signature]
+	if !known {
+		switch {
+		case c.maxSeriesPerMetric > 0 && len(series)-c.droppedSeries[key] >= c.maxSeriesPerMetric:
+			beyond = fmt.Sprintf("%d series of a metric", c.maxSeriesPerMetric)
+		case c.maxSeries > 0 && c.admittedSeries >= c.maxSeries:
+			beyond = fmt.Sprintf("%d series in total", c.maxSeries)
+			capHit = !c.maxSeriesHit
+			c.maxSeriesHit = true
+		default:
+			admitted = true
+			c.admittedSeries++
+		}
+		if !admitted && c.rememberedDrops >= maxRememberedDrops {
+			// reported before or not, it's dropped without a trace
+			c.mutex.Unlock()
+			return false
+		}
+		if series == nil {
+			series = make(map[string]bool)
+			c.seriesLabels[key] = series
+		}
+		series[signature] = admitted
+		if !admitted {
+			c.droppedSeries[key]++
+			c.rememberedDrops++
+			atomic.AddUint64(&c.droppedSeriesTotal, 1)
+		}
+	}
+	c.mutex.Unlock()
+	if !known && !admitted {
+		c.logger.Warnf("prometheusmetrics: dropping series %s%s beyond %s", name, signature, beyond)
+		if capHit && c.errorHandler != nil {
+			c.errorHandler(fmt.Errorf("not exporting %s%s and further new series: the provider exports %s", name, signature, beyond))
+		}
+		if c.onCardinalityExceeded != nil {
+			c.onCardinalityExceeded(name, labels)
+		}
+	}
+	return admitted
+}
+
+// cappedWriter drops the series beyond the cardinality caps.
+type cappedWriter struct {
+	metricWriter
+	config *PrometheusConfig
+}
+
+func (w cappedWriter) gauge(name string, val float64, labels prometheus.Labels) error {
+	if !w.config.admitSeries(w.config.createKey(name), name, labels) {
+		return nil
+	}
+	return w.metricWriter.gauge(name, val, labels)
+}
+
+func (w cappedWriter) counter(name string, val float64, labels prometheus.Labels) error {
+	if !w.config.admitSeries(w.config.createKey(name), name, labels) {
+		return nil
+	}
+	return w.metricWriter.counter(name, val, labels)
+}
+
+func (w cappedWriter) constMetric(name string, labels prometheus.Labels, metric prometheus.Metric) error {
+	if !w.config.admitSeries(metric.Desc().String(), name, labels) {
+		return nil
+	}
+	return w.metricWriter.constMetric(name, labels, metric)
+}
@@ -0,0 +1,119 @@
+package prometheusmetrics
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestMaxSeriesPerMetric(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var dropped []string
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLabelExtractor(func(name string) (string, prometheus.Labels) {
+			parts := strings.SplitN(name, "-for-topic-", 2)
+			return parts[0], prometheus.Labels{"for_topic": parts[1]}
+		}).
+		WithMaxSeriesPerMetric(2).
+		WithOnCardinalityExceeded(func(metricName string, droppedLabels prometheus.Labels) {
+			dropped = append(dropped, droppedLabels["for_topic"])
+		})
+	for _, topic := range []string{"a", "b", "c"} {
+		metricsRegistry.Register("records-for-topic-"+topic, metrics.NewGauge())
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(metrics) != 1 || len(metrics[0].GetMetric()) != 2 {
+		t.Fatalf("expected 2 series, got %v", metrics)
+	}
+	if len(dropped) != 1 {
+		t.Fatalf("expected 1 dropped label combination, got %v", dropped)
+	}
+	topics := []string{dropped[0]}
+	for _, series := range metrics[0].GetMetric() {
+		topics = append(topics, series.GetLabel()[0].GetValue())
+	}
+	sort.Strings(topics)
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(topics, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, topics)
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var handled []error
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithMaxSeries(3).
+		WithSelfMetrics(true).
+		WithErrorHandler(func(err error) {
+			handled = append(handled, err)
+		})
+	metricsRegistry.Register("histogram", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	pClient.UpdatePrometheusMetricsOnce()
+	for _, name := range []string{"request-1", "request-2", "request-3", "request-4"} {
+		metricsRegistry.Register(name, metrics.NewGauge())
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	exported := 0
+	var dropped float64
+	for _, metric := range metrics {
+		if strings.HasPrefix(metric.GetName(), "test_subsys_") {
+			exported += len(metric.GetMetric())
+		}
+		if metric.GetName() == "go_metrics_prometheus_series_dropped_total" {
+			dropped = metric.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	if exported != 3 || dropped != 2 {
+		t.Fatalf("expected 3 series exported and 2 dropped, got %d and %v", exported, dropped)
+	}
+	if len(handled) != 1 || !strings.Contains(handled[0].Error(), "3 series in total") {
+		t.Fatalf("expected a single error once the cap was hit, got %v", handled)
+	}
+}
+
+func TestMaxSeriesPerMetricRemembersBoundedDrops(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	dropped := 0
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLabelExtractor(func(name string) (string, prometheus.Labels) {
+			parts := strings.SplitN(name, "-for-request-", 2)
+			return parts[0], prometheus.Labels{"request": parts[1]}
+		}).
+		WithMaxSeriesPerMetric(1).
+		WithOnCardinalityExceeded(func(metricName string, droppedLabels prometheus.Labels) {
+			dropped++
+		})
+	for i := 0; i <= maxRememberedDrops+10; i++ {
+		metricsRegistry.Register("latency-for-request-"+strconv.Itoa(i), metrics.NewGauge())
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if remembered := len(pClient.seriesLabels[pClient.createKey("latency")]); remembered != maxRememberedDrops+1 {
+		t.Fatalf("expected %d series remembered, got %d", maxRememberedDrops+1, remembered)
+	}
+	if dropped != maxRememberedDrops {
+		t.Fatalf("expected %d drops reported, got %d", maxRememberedDrops, dropped)
+	}
+}
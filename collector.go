@@ -0,0 +1,258 @@
+package prometheusmetrics
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MissingMetricPolicy controls what a Collector exports for the series of a
+// metric that was removed from the go-metrics registry.
+type MissingMetricPolicy int
+
+const (
+	// Omit stops exporting the series of removed metrics.
+	Omit MissingMetricPolicy = iota
+	// Stale exports a Prometheus staleness marker for every gauge and counter
+	// series of a removed metric on the next scrape, so the series is
+	// considered absent immediately rather than after the lookback delta.
+	// Staleness markers only survive the protobuf exposition format; the text
+	// format renders them as a plain NaN.
+	Stale
+)
+
+// staleNaN is the NaN value Prometheus uses to mark a series as stale.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+// Collector returns a prometheus.Collector that reads the go-metrics registry
+// on every scrape rather than on every flush. Register it with a Prometheus
+// registry instead of running UpdatePrometheusMetrics. As the exported series
+// are only known once go-metrics are read, it is an unchecked collector.
+func (c *PrometheusConfig) Collector() prometheus.Collector {
+	return &pullCollector{
+		config:  c,
+		series:  make(map[string]constSeries),
+		emitted: make(map[string]*emission),
+	}
+}
+
+// WithChangeOnlyExport makes the Collector omit gauge and counter series whose
+// value hasn't changed since it last exported them, to shrink the scrape
+// payload of large, mostly static registries. A series is still exported at
+// least every maxSkip+1 scrapes. Histograms and summaries are always exported.
+//
+// This is an advanced option for bandwidth-constrained environments:
+// Prometheus marks a series missing from a scrape as stale, so omitted series
+// show gaps, rate() and friends see fewer samples and alerts on them may
+// flap. Keep maxSkip well below the lookback delta divided by the scrape
+// interval. It has no effect unless maxSkip is positive, nor on the registry
+// based UpdatePrometheusMetrics.
+func (c *PrometheusConfig) WithChangeOnlyExport(maxSkip int) *PrometheusConfig {
+	c.changeOnlyMaxSkip = maxSkip
+	return c
+}
+
+type pullCollector struct {
+	config  *PrometheusConfig
+	mutex   sync.Mutex
+	series  map[string]constSeries // gauge and counter series of the last scrape
+	emitted map[string]*emission   // by series, see WithChangeOnlyExport
+}
+
+// emission is the last exported value of a series and the number of scrapes
+// that omitted it since.
+type emission struct {
+	value   float64
+	skipped int
+}
+
+type constSeries struct {
+	desc        *prometheus.Desc
+	valueType   prometheus.ValueType
+	labelValues []string
+}
+
+func (p *pullCollector) Describe(ch chan<- *prometheus.Desc) {
+	// unchecked collector, see Collector
+}
+
+func (p *pullCollector) Collect(ch chan<- prometheus.Metric) {
+	w := &constWriter{
+		PrometheusConfig: p.config,
+		series:           make(map[string]constSeries),
+	}
+	// unlike registry flushes, scrapes don't hold flushMutex, see Reconfigure
+	p.config.configMutex.RLock()
+	if p.config.changeOnlyMaxSkip > 0 {
+		w.unchanged = p.unchanged
+	}
+	p.config.flush(w)
+	p.config.configMutex.RUnlock()
+
+	p.mutex.Lock()
+	for key := range p.emitted {
+		if _, ok := w.series[key]; !ok {
+			delete(p.emitted, key)
+		}
+	}
+	if p.config.missingPolicy == Stale {
+		for key, series := range p.series {
+			if _, ok := w.series[key]; !ok {
+				w.metrics = append(w.metrics, prometheus.MustNewConstMetric(series.desc, series.valueType, staleNaN, series.labelValues...))
+			}
+		}
+	}
+	p.series = w.series
+	p.mutex.Unlock()
+
+	for _, metric := range w.metrics {
+		ch <- metric
+	}
+}
+
+// unchanged reports whether the series key may be omitted from this scrape,
+// see WithChangeOnlyExport.
+func (p *pullCollector) unchanged(key string, val float64) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	last, ok := p.emitted[key]
+	if ok && last.value == val && last.skipped < p.config.changeOnlyMaxSkip {
+		last.skipped++
+		return true
+	}
+	p.emitted[key] = &emission{value: val}
+	return false
+}
+
+// constWriter buffers the series of a scrape as const metrics.
+type constWriter struct {
+	*PrometheusConfig
+	metrics   []prometheus.Metric
+	series    map[string]constSeries
+	timestamp time.Time                          // of histograms and summaries, unless zero
+	unchanged func(key string, val float64) bool // omits series, unless nil
+}
+
+func (w *constWriter) gauge(name string, val float64, labels prometheus.Labels) error {
+	if w.deletesSeries(val) {
+		return nil
+	}
+	return w.write(name, prometheus.GaugeValue, w.rounded(val), labels)
+}
+
+func (w *constWriter) counter(name string, val float64, labels prometheus.Labels) error {
+	return w.write(name, prometheus.CounterValue, val, labels)
+}
+
+func (w *constWriter) removeGauge(name string) {
+	// series only last one flush
+}
+
+func (w *constWriter) removeCounter(name string) {
+	// series only last one flush
+}
+
+func (w *constWriter) constMetric(name string, labels prometheus.Labels, metric prometheus.Metric) error {
+	if !w.timestamp.IsZero() {
+		metric = prometheus.NewMetricWithTimestamp(w.timestamp, metric)
+	}
+	w.metrics = append(w.metrics, metric)
+	return nil
+}
+
+func (w *constWriter) write(name string, valueType prometheus.ValueType, val float64, labels prometheus.Labels) error {
+	fqName := w.fqName(name)
+	names := labelNames(labels)
+	var opts prometheus.Opts
+	if valueType == prometheus.GaugeValue {
+		opts = w.gaugeOpts
+	}
+	series := constSeries{
+		desc:        prometheus.NewDesc(fqName, w.helpWithOpts(opts, name, name), names, w.constLabelsWithOpts(opts, labels)),
+		valueType:   valueType,
+		labelValues: make([]string, len(names)),
+	}
+	for i, labelName := range names {
+		series.labelValues[i] = labels[labelName]
+	}
+	metric, err := prometheus.NewConstMetric(series.desc, valueType, val, series.labelValues...)
+	if err != nil {
+		return err
+	}
+	key := fqName + labelSignature(labels)
+	w.series[key] = series
+	if w.unchanged == nil || !w.unchanged(key, val) {
+		w.metrics = append(w.metrics, metric)
+	}
+	return nil
+}
+
+// ExportMode controls how flushes export go-metrics to the Prometheus
+// registry.
+type ExportMode int
+
+const (
+	// Stateful exports gauges and counters to gauge and counter vectors,
+	// which keep exporting the series of metrics removed from the go-metrics
+	// registry, and histograms and summaries as const metrics.
+	Stateful ExportMode = iota
+	// ConstMetric exports the series of a flush as const metrics of a single
+	// collector, replacing those of the previous flush, so every type of
+	// metric is exported alike and the series of metrics removed from the
+	// go-metrics registry disappear with the next flush. Metrics may also
+	// change their label names, which Stateful reports as an error as the
+	// Prometheus registry holds on to the label names of a name. Options
+	// acting on the gauge and counter vectors, e.g. LastValue, don't apply.
+	ConstMetric
+)
+
+// WithExportMode sets how flushes export go-metrics, Stateful by default.
+func (c *PrometheusConfig) WithExportMode(mode ExportMode) *PrometheusConfig {
+	c.exportMode = mode
+	return c
+}
+
+// flushConst flushes go-metrics to the const metrics of the flushed
+// collector, registering it on first use. It must be called with flushMutex
+// held.
+func (c *PrometheusConfig) flushConst(t time.Time) error {
+	if c.flushed == nil {
+		flushed := &flushedCollector{}
+		if _, err := c.register(flushed); err != nil {
+			return err
+		}
+		c.flushed = flushed
+	}
+	w := &constWriter{
+		PrometheusConfig: c,
+		series:           make(map[string]constSeries),
+		timestamp:        t,
+	}
+	err := c.flush(w)
+	c.flushed.mutex.Lock()
+	c.flushed.metrics = w.metrics
+	c.flushed.mutex.Unlock()
+	return err
+}
+
+// flushedCollector exports the const metrics of the last flush. As they're
+// only known once go-metrics are read, it is an unchecked collector.
+type flushedCollector struct {
+	mutex   sync.Mutex
+	metrics []prometheus.Metric
+}
+
+func (f *flushedCollector) Describe(ch chan<- *prometheus.Desc) {
+	// unchecked collector
+}
+
+func (f *flushedCollector) Collect(ch chan<- prometheus.Metric) {
+	f.mutex.Lock()
+	metrics := f.metrics
+	f.mutex.Unlock()
+	for _, metric := range metrics {
+		ch <- metric
+	}
+}
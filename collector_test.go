@@ -0,0 +1,123 @@
+package prometheusmetrics
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestCollectorReadsOnScrape(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithNativeCounters(true)
+	prometheusRegistry.MustRegister(pClient.Collector())
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	metricsRegistry.Register("histogram", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	cntr.Inc(5)
+
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metric families, got %d", len(metrics))
+	}
+	if value := metrics[0].GetMetric()[0].Counter.GetValue(); value != 5 {
+		t.Fatalf("Expected: 5, actual: %v", value)
+	}
+}
+
+func TestCollectorStaleMarkers(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithMissingMetricPolicy(Stale)
+	prometheusRegistry.MustRegister(pClient.Collector())
+	gm := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gm)
+	gm.Update(3)
+
+	metrics, _ := prometheusRegistry.Gather()
+	if value := metrics[0].GetMetric()[0].Gauge.GetValue(); value != 3 {
+		t.Fatalf("Expected: 3, actual: %v", value)
+	}
+
+	metricsRegistry.Unregister("gauge")
+	metrics, _ = prometheusRegistry.Gather()
+	if len(metrics) != 1 {
+		t.Fatalf("expected a staleness marker for the removed gauge, got %v", metrics)
+	}
+	if value := metrics[0].GetMetric()[0].Gauge.GetValue(); math.Float64bits(value) != math.Float64bits(staleNaN) {
+		t.Fatalf("Expected staleness marker, actual: %v", value)
+	}
+
+	metrics, _ = prometheusRegistry.Gather()
+	if len(metrics) != 0 {
+		t.Fatalf("staleness marker was exported more than once: %v", metrics)
+	}
+}
+
+func TestConstMetricExportMode(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithExportMode(ConstMetric)
+	gm := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gm)
+	metricsRegistry.Register("histogram", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	gm.Update(3)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metric families, got %d", len(metrics))
+	}
+	if value := metrics[0].GetMetric()[0].Gauge.GetValue(); value != 3 {
+		t.Fatalf("Expected: 3, actual: %v", value)
+	}
+
+	metricsRegistry.Unregister("gauge")
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, _ = prometheusRegistry.Gather()
+	if len(metrics) != 1 || metrics[0].GetName() != "test_subsys_histogram_histogram" {
+		t.Fatalf("expected the removed gauge's series to disappear, got %v", metrics)
+	}
+	if err := pClient.Reset(); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if metrics, _ = prometheusRegistry.Gather(); len(metrics) != 0 {
+		t.Fatalf("expected Reset to clear the series, got %v", metrics)
+	}
+}
+
+func TestCollectorChangeOnlyExport(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithChangeOnlyExport(1)
+	prometheusRegistry.MustRegister(pClient.Collector())
+	gm := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gm)
+	gm.Update(3)
+
+	for i, expected := range []int{1, 1, 0, 1, 0} {
+		if i == 1 {
+			gm.Update(4)
+		}
+		metrics, err := prometheusRegistry.Gather()
+		if err != nil {
+			t.Fatalf("gather failed: %v", err)
+		}
+		if len(metrics) != expected {
+			t.Fatalf("scrape %d: expected %d metric families, got %v", i, expected, metrics)
+		}
+	}
+}
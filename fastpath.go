@@ -0,0 +1,98 @@
+package prometheusmetrics
+
+import (
+	"reflect"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+// fastGauge is the gauge a go-metrics Counter, Gauge or GaugeFloat64 was last
+// exported to, so it can be updated again without resolving its name and
+// labels.
+type fastGauge struct {
+	metric   interface{}
+	gauge    prometheus.Gauge
+	valueKey string // of lastValues
+}
+
+// fastPath reports whether flushes to w may update the gauges of simple
+// go-metrics directly. Options making their export depend on more than their
+// value disable it.
+func (c *PrometheusConfig) fastPath(w metricWriter) bool {
+	_, ok := w.(registryWriter)
+	return ok && !c.noFastPath && !c.dualCounters && c.counterDetectionWindow <= 0
+}
+
+// exportFast updates the gauge the go-metric name was last exported to,
+// reporting whether it was. Should reading it panic, e.g. in the function of
+// a functional gauge, the panic is reported like by exportMetric and the
+// gauge forgotten.
+func (c *PrometheusConfig) exportFast(report func(error), name string, i interface{}) (exported bool) {
+	fast, ok := c.fastGauges[name]
+	if !ok || fast.metric != i {
+		return false
+	}
+	// the gauge is cached again once the go-metric was read
+	delete(c.fastGauges, name)
+	exported = true
+	defer recoverExport(report, name)
+	var val float64
+	switch metric := i.(type) {
+	case metrics.Counter:
+		val = float64(metric.Count())
+	case metrics.Gauge:
+		val = float64(metric.Value())
+	case metrics.GaugeFloat64:
+		val = metric.Value()
+	}
+	if c.deletesSeries(val) {
+		// the gauge must be removed from its vector
+		return false
+	}
+	c.fastGauges[name] = fast
+	val = c.rounded(val)
+	fast.gauge.Set(val)
+	c.lastValues[fast.valueKey] = val
+	return true
+}
+
+// cacheFast remembers the gauge the go-metric rawName was exported to, if it
+// was exported to a single one.
+func (c *PrometheusConfig) cacheFast(rawName string, i interface{}) {
+	switch i.(type) {
+	case metrics.Counter, metrics.Gauge, metrics.GaugeFloat64:
+	default:
+		return
+	}
+	if reflect.TypeOf(i).Kind() != reflect.Ptr {
+		// only go-metrics that are pointers can be told apart from the
+		// ones replacing them
+		return
+	}
+	name, labels := c.exportedName(rawName)
+	if _, hasStates := c.stateMappings[name]; hasStates {
+		return
+	}
+	kind := c.kindOf(rawName)
+	if _, isCounter := i.(metrics.Counter); isCounter && kind == KindDefault && c.nativeCounters {
+		kind = KindCounter
+	}
+	if kind == KindCounter {
+		return
+	}
+	key := c.createKey(withUnit(name, c.metadata[rawName].Unit))
+	g, ok := c.gauges[key]
+	if !ok {
+		return
+	}
+	if _, exported := c.lastValues[key+labelSignature(labels)]; !exported {
+		// e.g. removed, see WithDeleteSeriesOnNaN
+		return
+	}
+	gauge, err := g.GetMetricWith(labels)
+	if err != nil {
+		return
+	}
+	c.fastGauges[rawName] = fastGauge{metric: i, gauge: gauge, valueKey: key + labelSignature(labels)}
+}
@@ -0,0 +1,95 @@
+package prometheusmetrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Handler returns an http.Handler that flushes go-metrics into the Prometheus
+// registry and then serves it, so every scrape sees fresh values. The
+// registry passed to NewPrometheusProvider must also be a prometheus.Gatherer.
+//
+// A running UpdatePrometheusMetrics loop skips its next tick after a scrape
+// triggered flush, so expensive histograms aren't snapshotted twice per
+// interval.
+func (c *PrometheusConfig) Handler() http.Handler {
+	gatherer, err := c.Gatherer()
+	if err != nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		})
+	}
+	metricsHandler := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.UpdatePrometheusMetricsOnce()
+		atomic.StoreInt64(&c.lastScrapeFlush, time.Now().UnixNano())
+		metricsHandler.ServeHTTP(w, r)
+	})
+}
+
+// Gatherer returns the Prometheus registry passed to NewPrometheusProvider as
+// a prometheus.Gatherer, or an error if it isn't one.
+func (c *PrometheusConfig) Gatherer() (prometheus.Gatherer, error) {
+	gatherer, ok := c.promRegistry.(prometheus.Gatherer)
+	if !ok {
+		return nil, fmt.Errorf("prometheus registry %T is not a Gatherer", c.promRegistry)
+	}
+	return gatherer, nil
+}
+
+// TextExposition flushes once and returns the Prometheus registry's metrics in
+// the text exposition format served on /metrics, e.g. for admin pages or
+// tests. The registry must also be a prometheus.Gatherer.
+func (c *PrometheusConfig) TextExposition() (string, error) {
+	gatherer, err := c.Gatherer()
+	if err != nil {
+		return "", err
+	}
+	if err := c.UpdatePrometheusMetricsOnce(); err != nil {
+		return "", err
+	}
+	families, err := gatherer.Gather()
+	if err != nil {
+		return "", err
+	}
+	var text bytes.Buffer
+	encoder := expfmt.NewEncoder(&text, expfmt.FmtText)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return "", err
+		}
+	}
+	return text.String(), nil
+}
+
+// gatherDebounce is the time within which GathererWithFlush flushes at most
+// once, e.g. while several gatherers sharing it are gathered for one scrape.
+const gatherDebounce = time.Second
+
+// GathererWithFlush returns a prometheus.Gatherer gathering inner after
+// flushing go-metrics into the Prometheus registry, for custom gathering
+// pipelines. Gathers flush at most once within a second. Like scrapes of the
+// Handler, they make a running UpdatePrometheusMetrics loop skip its next
+// tick.
+func (c *PrometheusConfig) GathererWithFlush(inner prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		if !c.scrapeFlushedWithin(gatherDebounce) {
+			c.UpdatePrometheusMetricsOnce()
+			atomic.StoreInt64(&c.lastScrapeFlush, time.Now().UnixNano())
+		}
+		return inner.Gather()
+	})
+}
+
+func (c *PrometheusConfig) scrapeFlushedWithin(d time.Duration) bool {
+	lastScrapeFlush := atomic.LoadInt64(&c.lastScrapeFlush)
+	return lastScrapeFlush != 0 && time.Since(time.Unix(0, lastScrapeFlush)) < d
+}
@@ -0,0 +1,110 @@
+package prometheusmetrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestHandlerFlushesOnScrape(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	cntr.Inc(42)
+
+	if pClient.scrapeFlushedWithin(time.Minute) {
+		t.Fatalf("no scrape happened yet")
+	}
+
+	recorder := httptest.NewRecorder()
+	pClient.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	if !strings.Contains(string(body), "test_subsys_counter 42") {
+		t.Fatalf("scrape didn't flush fresh values:\n%s", body)
+	}
+	if !pClient.scrapeFlushedWithin(time.Minute) {
+		t.Fatalf("scrape flush wasn't recorded for the flush loop")
+	}
+}
+
+func TestHandlerRequiresGatherer(t *testing.T) {
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.WrapRegistererWithPrefix("x_", prometheus.NewRegistry()), 1*time.Second)
+	recorder := httptest.NewRecorder()
+	pClient.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != 500 {
+		t.Fatalf("Expected: 500, actual: %d", recorder.Code)
+	}
+}
+
+func TestTextExposition(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	gm := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gm)
+	gm.Update(7)
+
+	text, err := pClient.TextExposition()
+	if err != nil {
+		t.Fatalf("text exposition failed: %v", err)
+	}
+	expected := "# HELP test_subsys_gauge gauge\n# TYPE test_subsys_gauge gauge\ntest_subsys_gauge 7\n"
+	if text != expected {
+		t.Fatalf("Expected: %q, actual: %q", expected, text)
+	}
+}
+
+func TestGatherer(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	pClient.UpdatePrometheusMetricsOnce()
+
+	gatherer, err := pClient.Gatherer()
+	if err != nil {
+		t.Fatalf("registry wasn't returned as a Gatherer: %v", err)
+	}
+	if metrics, _ := gatherer.Gather(); len(metrics) != 1 {
+		t.Fatalf("expected 1 metric family, got %d", len(metrics))
+	}
+
+	wrapped := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.WrapRegistererWithPrefix("x_", prometheus.NewRegistry()), 1*time.Second)
+	if _, err := wrapped.Gatherer(); err == nil {
+		t.Fatalf("a plain Registerer was returned as a Gatherer")
+	}
+}
+
+func TestGathererWithFlush(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	otherRegistry := prometheus.NewRegistry()
+	otherRegistry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "other", Help: "other"}))
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gauge)
+	gatherer := pClient.GathererWithFlush(prometheus.Gatherers{prometheusRegistry, otherRegistry})
+
+	var values []float64
+	for _, val := range []int64{1, 2} {
+		gauge.Update(val)
+		metrics, err := gatherer.Gather()
+		if err != nil {
+			t.Fatalf("gather failed: %v", err)
+		}
+		if len(metrics) != 2 {
+			t.Fatalf("expected the metrics of both registries, got %v", metrics)
+		}
+		values = append(values, metrics[1].GetMetric()[0].GetGauge().GetValue())
+	}
+	// the second gather is debounced
+	if values[0] != 1 || values[1] != 1 {
+		t.Fatalf("Expected: %v, actual: %v", []float64{1, 1}, values)
+	}
+}
@@ -0,0 +1,26 @@
+package prometheusmetrics
+
+// Logger logs operational issues of a provider, e.g. metrics skipped because
+// their names collide, in human-readable form. Unlike the error handler, see
+// WithErrorHandler, it's meant for people rather than programs.
+type Logger interface {
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// noopLogger is the Logger of providers without one.
+type noopLogger struct{}
+
+func (noopLogger) Warnf(format string, args ...interface{})  {}
+func (noopLogger) Errorf(format string, args ...interface{}) {}
+
+// WithLogger sets the Logger errors of flushes, newly skipped metrics,
+// collision renames and series dropped by the cardinality cap are logged to.
+// Nothing is logged by default.
+func (c *PrometheusConfig) WithLogger(logger Logger) *PrometheusConfig {
+	if logger == nil {
+		logger = noopLogger{}
+	}
+	c.logger = logger
+	return c
+}
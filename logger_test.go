@@ -0,0 +1,49 @@
+package prometheusmetrics
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "WARN "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "ERROR "+fmt.Sprintf(format, args...))
+}
+
+func TestLogger(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	logger := &recordingLogger{}
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLogger(logger).
+		WithTypeFilter(func(metric interface{}) bool {
+			_, isMeter := metric.(metrics.Meter)
+			return !isMeter
+		})
+	metricsRegistry.Register("requests.served", metrics.NewGauge())
+	metricsRegistry.Register("requests-served", metrics.NewGauge())
+	metricsRegistry.Register("meter", metrics.NewMeter())
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+
+	owner, skipped := "requests.served", "requests-served"
+	if _, ok := pClient.SkippedMetrics()[owner]; ok {
+		owner, skipped = skipped, owner
+	}
+	expected := []string{fmt.Sprintf("WARN prometheusmetrics: not exporting %s: name collides with %s", skipped, owner)}
+	if !reflect.DeepEqual(logger.lines, expected) {
+		t.Fatalf("Expected: %q, actual: %q", expected, logger.lines)
+	}
+}
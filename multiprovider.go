@@ -0,0 +1,145 @@
+package prometheusmetrics
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// MultiProvider exports one go-metrics registry through several providers,
+// routes, each with its own namespace, subsystem, labels and other settings,
+// in a single flush loop. Every go-metric is exported by the route with the
+// longest prefix of its name, under its name without the prefix. Go-metrics
+// without a matching route are exported by the default route, if any.
+type MultiProvider struct {
+	Registry      metrics.Registry // Registry to be exported
+	FlushInterval time.Duration    // interval to update prom metrics
+	routes        []route
+	defaultRoute  *route
+	mutex         sync.Mutex
+}
+
+type route struct {
+	prefix   string
+	config   *PrometheusConfig
+	registry *routeRegistry
+}
+
+// NewMultiProvider returns a MultiProvider exporting r every FlushInterval.
+func NewMultiProvider(r metrics.Registry, FlushInterval time.Duration) *MultiProvider {
+	return &MultiProvider{
+		Registry:      r,
+		FlushInterval: FlushInterval,
+	}
+}
+
+// AddRoute exports the go-metrics whose names start with prefix through c,
+// which is made to read them from the MultiProvider's registry.
+func (m *MultiProvider) AddRoute(prefix string, c *PrometheusConfig) *MultiProvider {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.routes = append(m.routes, m.newRoute(prefix, c))
+	return m
+}
+
+// WithDefaultRoute exports the go-metrics no route matches through c.
+func (m *MultiProvider) WithDefaultRoute(c *PrometheusConfig) *MultiProvider {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	defaultRoute := m.newRoute("", c)
+	m.defaultRoute = &defaultRoute
+	return m
+}
+
+func (m *MultiProvider) newRoute(prefix string, c *PrometheusConfig) route {
+	registry := &routeRegistry{Registry: m.Registry, prefix: prefix}
+	c.Registry = registry
+	return route{prefix: prefix, config: c, registry: registry}
+}
+
+// route returns the route exporting the go-metric name, or nil if none does.
+func (m *MultiProvider) route(name string) *route {
+	var matched *route
+	for i := range m.routes {
+		r := &m.routes[i]
+		if strings.HasPrefix(name, r.prefix) && (matched == nil || len(r.prefix) > len(matched.prefix)) {
+			matched = r
+		}
+	}
+	if matched == nil {
+		return m.defaultRoute
+	}
+	return matched
+}
+
+func (m *MultiProvider) UpdatePrometheusMetrics() {
+	ticker := time.NewTicker(m.FlushInterval)
+	defer ticker.Stop()
+	for _ = range ticker.C {
+		m.UpdatePrometheusMetricsOnce()
+	}
+}
+
+// UpdatePrometheusMetricsOnce dispatches every go-metric to its route and
+// flushes all routes, returning the first error of any.
+func (m *MultiProvider) UpdatePrometheusMetricsOnce() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	routes := append([]route{}, m.routes...)
+	if m.defaultRoute != nil {
+		routes = append(routes, *m.defaultRoute)
+	}
+	entries := make(map[*routeRegistry][]routeEntry, len(routes))
+	m.Registry.Each(func(name string, i interface{}) {
+		if r := m.route(name); r != nil {
+			entries[r.registry] = append(entries[r.registry], routeEntry{strings.TrimPrefix(name, r.prefix), i})
+		}
+	})
+	for _, r := range routes {
+		r.registry.setEntries(entries[r.registry])
+	}
+	var flushErr error
+	for _, r := range routes {
+		if err := r.config.UpdatePrometheusMetricsOnce(); err != nil && flushErr == nil {
+			flushErr = err
+		}
+	}
+	return flushErr
+}
+
+// routeRegistry presents the go-metrics dispatched to a route to its
+// provider, under their names without the route's prefix. Its provider's
+// handlers and collectors may read it while the MultiProvider dispatches.
+type routeRegistry struct {
+	metrics.Registry
+	prefix  string
+	mutex   sync.Mutex
+	entries []routeEntry
+}
+
+type routeEntry struct {
+	name   string
+	metric interface{}
+}
+
+func (r *routeRegistry) Each(f func(string, interface{})) {
+	r.mutex.Lock()
+	entries := r.entries
+	r.mutex.Unlock()
+	for _, e := range entries {
+		f(e.name, e.metric)
+	}
+}
+
+func (r *routeRegistry) Get(name string) interface{} {
+	return r.Registry.Get(r.prefix + name)
+}
+
+// setEntries replaces the go-metrics dispatched to the route.
+func (r *routeRegistry) setEntries(entries []routeEntry) {
+	r.mutex.Lock()
+	r.entries = entries
+	r.mutex.Unlock()
+}
@@ -0,0 +1,68 @@
+package prometheusmetrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestMultiProviderRoutes(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	multiProvider := NewMultiProvider(metricsRegistry, 1*time.Second).
+		AddRoute("db.", NewPrometheusProvider(nil, "app", "db", prometheusRegistry, 0)).
+		AddRoute("db.replica.", NewPrometheusProvider(nil, "app", "replica", prometheusRegistry, 0)).
+		WithDefaultRoute(NewPrometheusProvider(nil, "app", "", prometheusRegistry, 0))
+	for _, name := range []string{"db.queries", "db.replica.lag", "requests"} {
+		metricsRegistry.Register(name, metrics.NewGauge())
+	}
+	if err := multiProvider.UpdatePrometheusMetricsOnce(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	var names []string
+	for _, metric := range metrics {
+		names = append(names, metric.GetName())
+	}
+	expected := []string{"app_db_queries", "app_replica_lag", "app_requests"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, names)
+	}
+}
+
+func TestMultiProviderRouteRegistry(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	db := NewPrometheusProvider(nil, "app", "db", prometheus.NewRegistry(), 0)
+	multiProvider := NewMultiProvider(metricsRegistry, 1*time.Second).
+		AddRoute("db.", db)
+	queries := metrics.NewGauge()
+	metricsRegistry.Register("db.queries", queries)
+
+	if db.Registry.Get("queries") != queries {
+		t.Fatalf("route doesn't get go-metrics by their name without its prefix")
+	}
+
+	// the route's provider reads its go-metrics while routes are dispatched
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			multiProvider.UpdatePrometheusMetricsOnce()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		db.Registry.Each(func(name string, i interface{}) {
+			if name != "queries" {
+				t.Errorf("Expected: queries, actual: %v", name)
+			}
+		})
+	}
+	<-done
+}
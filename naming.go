@@ -0,0 +1,105 @@
+package prometheusmetrics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithNameValidator skips the series whose fully qualified Prometheus name
+// doesn't match validator, e.g. to enforce a naming convention, reporting
+// them to the error handler on every flush. Unlike the sanitizing of names,
+// which replaces invalid characters, it checks their structure.
+func (c *PrometheusConfig) WithNameValidator(validator *regexp.Regexp) *PrometheusConfig {
+	c.nameValidator = validator
+	return c
+}
+
+// validated returns w skipping the series whose names don't match the name
+// validator, if any.
+func (c *PrometheusConfig) validated(w metricWriter) metricWriter {
+	if c.nameValidator == nil {
+		return w
+	}
+	return validatingWriter{w, c}
+}
+
+// validatingWriter skips the series whose names don't match the name
+// validator.
+type validatingWriter struct {
+	metricWriter
+	config *PrometheusConfig
+}
+
+func (w validatingWriter) gauge(name string, val float64, labels prometheus.Labels) error {
+	if err := w.config.validateName(w.config.fqName(name)); err != nil {
+		return err
+	}
+	return w.metricWriter.gauge(name, val, labels)
+}
+
+func (w validatingWriter) counter(name string, val float64, labels prometheus.Labels) error {
+	if err := w.config.validateName(w.config.fqName(name)); err != nil {
+		return err
+	}
+	return w.metricWriter.counter(name, val, labels)
+}
+
+func (w validatingWriter) constMetric(name string, labels prometheus.Labels, metric prometheus.Metric) error {
+	if err := w.config.validateName(descName(metric.Desc())); err != nil {
+		return err
+	}
+	return w.metricWriter.constMetric(name, labels, metric)
+}
+
+// WithCounterTotalSuffix appends _total to the names of the series exported
+// as Prometheus counters that don't end with it yet, as the Prometheus naming
+// conventions require, e.g. for native counters, see WithNativeCounters.
+func (c *PrometheusConfig) WithCounterTotalSuffix(enabled bool) *PrometheusConfig {
+	c.counterTotalSuffix = enabled
+	return c
+}
+
+// totalSuffixed returns w appending _total to counter names, if enabled. As
+// it only renames counters, it doesn't stand in the way of the fast path.
+func (c *PrometheusConfig) totalSuffixed(w metricWriter) metricWriter {
+	if !c.counterTotalSuffix {
+		return w
+	}
+	return totalSuffixingWriter{w, c}
+}
+
+// totalSuffixingWriter appends _total to counter names.
+type totalSuffixingWriter struct {
+	metricWriter
+	config *PrometheusConfig
+}
+
+func (w totalSuffixingWriter) counter(name string, val float64, labels prometheus.Labels) error {
+	if !strings.HasSuffix(w.config.flattenKey(name), "_total") {
+		name += "_total"
+	}
+	return w.metricWriter.counter(name, val, labels)
+}
+
+func (c *PrometheusConfig) validateName(fqName string) error {
+	if !c.nameValidator.MatchString(fqName) {
+		return fmt.Errorf("not exporting %s: the name doesn't match %v", fqName, c.nameValidator)
+	}
+	return nil
+}
+
+// descName returns the fully qualified name of desc, which client_golang only
+// exposes through its String method.
+func descName(desc *prometheus.Desc) string {
+	described := desc.String()
+	start := strings.Index(described, `fqName: "`)
+	if start < 0 {
+		return ""
+	}
+	name := described[start+len(`fqName: "`):]
+	// valid names don't contain quotes, which would be escaped
+	return name[:strings.Index(name, `"`)]
+}
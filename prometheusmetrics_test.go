@@ -1,11 +1,16 @@
 package prometheusmetrics
 
 import (
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rcrowley/go-metrics"
 	"math"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -218,3 +223,2804 @@ func TestPrometheusTimerGetUpdated(t *testing.T) {
 		)
 	}
 }
+
+func TestPrometheusGaugeStateMapping(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithStateMapping("status", map[int]string{0: "down", 1: "starting", 2: "up"})
+	status := metrics.NewGauge()
+	metricsRegistry.Register("status", status)
+	plain := metrics.NewGauge()
+	metricsRegistry.Register("plain", plain)
+	status.Update(2)
+	plain.Update(2)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, _ := prometheusRegistry.Gather()
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metric families, got %d", len(metrics))
+	}
+
+	if value := metrics[0].GetMetric()[0].Gauge.GetValue(); value != 2 {
+		t.Fatalf("unmapped gauge should stay numeric, got %v", value)
+	}
+
+	stateValues := make(map[string]float64)
+	for _, metric := range metrics[1].GetMetric() {
+		stateValues[metric.GetLabel()[0].GetValue()] = metric.Gauge.GetValue()
+	}
+	expectedValues := map[string]float64{"down": 0, "starting": 0, "up": 1}
+	if !reflect.DeepEqual(stateValues, expectedValues) {
+		t.Fatalf("Expected: %v, actual: %v", expectedValues, stateValues)
+	}
+}
+
+func TestPrometheusBucketHelpers(t *testing.T) {
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+
+	if !reflect.DeepEqual(pClient.WithDefaultHistogramBuckets().histogramBuckets, prometheus.DefBuckets) {
+		t.Fatalf("default buckets not applied: %v", pClient.histogramBuckets)
+	}
+	if expected := []float64{1, 3, 5}; !reflect.DeepEqual(pClient.WithLinearBuckets(1, 2, 3).histogramBuckets, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, pClient.histogramBuckets)
+	}
+	if expected := []float64{1, 2, 4, 8}; !reflect.DeepEqual(pClient.WithExponentialBuckets(1, 2, 4).histogramBuckets, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, pClient.histogramBuckets)
+	}
+}
+
+func TestPrometheusNativeCounterResetDetection(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithNativeCounters(true)
+
+	exported := func() float64 {
+		pClient.UpdatePrometheusMetricsOnce()
+		metrics, _ := prometheusRegistry.Gather()
+		if len(metrics) != 1 {
+			t.Fatalf("expected 1 metric family, got %d", len(metrics))
+		}
+		return metrics[0].GetMetric()[0].Counter.GetValue()
+	}
+
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	cntr.Inc(10)
+	if value := exported(); value != 10 {
+		t.Fatalf("Expected: 10, actual: %v", value)
+	}
+
+	metricsRegistry.Unregister("counter")
+	cntr = metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	cntr.Inc(3)
+	if value := exported(); value != 13 {
+		t.Fatalf("reset counter not detected. Expected: 13, actual: %v", value)
+	}
+
+	cntr.Inc(4)
+	if value := exported(); value != 17 {
+		t.Fatalf("Expected: 17, actual: %v", value)
+	}
+}
+
+func TestPrometheusNativeCounterBelowZero(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var errs []error
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithNativeCounters(true).
+		WithErrorHandler(func(err error) {
+			errs = append(errs, err)
+		})
+
+	exported := func() float64 {
+		pClient.UpdatePrometheusMetricsOnce()
+		metrics, _ := prometheusRegistry.Gather()
+		if len(metrics) != 1 {
+			t.Fatalf("expected 1 metric family, got %d", len(metrics))
+		}
+		return metrics[0].GetMetric()[0].Counter.GetValue()
+	}
+
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	cntr.Dec(3)
+	if value := exported(); value != 0 {
+		t.Fatalf("Expected: 0, actual: %v", value)
+	}
+	cntr.Inc(5)
+	if value := exported(); value != 5 {
+		t.Fatalf("Expected: 5, actual: %v", value)
+	}
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+}
+
+func TestPrometheusDescriptions(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithDescriptions(map[string]string{
+			"described": "A described gauge",
+			"latency":   "Request latency",
+		})
+	metricsRegistry.Register("described", metrics.NewGauge())
+	metricsRegistry.Register("undescribed", metrics.NewGauge())
+	metricsRegistry.Register("latency", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, _ := prometheusRegistry.Gather()
+
+	help := make(map[string]string)
+	for _, metric := range metrics {
+		help[metric.GetName()] = metric.GetHelp()
+	}
+	expected := map[string]string{
+		"test_subsys_described":         "A described gauge",
+		"test_subsys_undescribed":       "undescribed",
+		"test_subsys_latency_histogram": "Request latency",
+	}
+	for name, expectedHelp := range expected {
+		if help[name] != expectedHelp {
+			t.Fatalf("help for %s does not match. Expected: %q, actual: %q", name, expectedHelp, help[name])
+		}
+	}
+}
+
+func TestPrometheusAllowedLabels(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLabelExtractor(func(name string) (string, prometheus.Labels) {
+			parts := strings.Split(name, ".")
+			return parts[0], prometheus.Labels{"region": parts[1], "request_id": parts[2]}
+		}).
+		WithAllowedLabels([]string{"region"})
+	metricsRegistry.Register("requests.eu.1234", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, _ := prometheusRegistry.Gather()
+	if len(metrics) != 1 {
+		t.Fatalf("expected 1 metric family, got %d", len(metrics))
+	}
+
+	serialized := fmt.Sprint(metrics[0])
+	expected := `name:"test_subsys_requests" help:"requests" type:GAUGE metric:<label:<name:"region" value:"eu" > gauge:<value:0 > > `
+	if serialized != expected {
+		t.Fatalf("disallowed label wasn't dropped:\n+ %s\n- %s", serialized, expected)
+	}
+}
+
+func TestPrometheusTimerCounterAndGauges(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTimerMode(ModeCounterAndGauges).
+		WithTimerUnit(time.Second)
+	timer := metrics.NewTimer()
+	metricsRegistry.Register("timer", timer)
+	timer.Update(2 * time.Second)
+	timer.Update(4 * time.Second)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, _ := prometheusRegistry.Gather()
+
+	metricValues := make(map[string]float64)
+	for _, metric := range metrics {
+		if metric.GetType().String() == "COUNTER" {
+			metricValues[metric.GetName()] = metric.GetMetric()[0].Counter.GetValue()
+		} else {
+			metricValues[metric.GetName()] = metric.GetMetric()[0].Gauge.GetValue()
+		}
+	}
+	expectedValues := map[string]float64{
+		"test_subsys_timer_count": 2,
+		"test_subsys_timer_sum":   6,
+		"test_subsys_timer_max":   4,
+		"test_subsys_timer_min":   2,
+		"test_subsys_timer_mean":  3,
+	}
+	if !reflect.DeepEqual(metricValues, expectedValues) {
+		t.Fatalf("Expected: %v, actual: %v", expectedValues, metricValues)
+	}
+}
+
+func TestPrometheusConstLabelsSharedRegistry(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	for tenant, count := range map[string]int64{"a": 1, "b": 2} {
+		metricsRegistry := metrics.NewRegistry()
+		pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+			WithConstLabels(prometheus.Labels{"tenant": tenant})
+		cntr := metrics.NewCounter()
+		metricsRegistry.Register("counter", cntr)
+		metricsRegistry.Register("histogram", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+		cntr.Inc(count)
+		pClient.UpdatePrometheusMetricsOnce()
+		// flushing twice must reuse the registered collectors
+		pClient.UpdatePrometheusMetricsOnce()
+	}
+
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("providers with distinct const labels collided: %v", err)
+	}
+	series := make(map[string]int)
+	for _, metric := range metrics {
+		series[metric.GetName()] = len(metric.GetMetric())
+	}
+	if series["test_subsys_counter"] != 2 || series["test_subsys_histogram_histogram"] != 2 {
+		t.Fatalf("expected a series per tenant, got %v", series)
+	}
+	tenants := metrics[0].GetMetric()
+	if tenants[0].Gauge.GetValue() != 1 || tenants[1].Gauge.GetValue() != 2 {
+		t.Fatalf("tenant values were mixed up: %v", tenants)
+	}
+}
+
+func TestPrometheusInstanceLabel(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	for _, instance := range []string{"orders", "payments"} {
+		metricsRegistry := metrics.NewRegistry()
+		pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+			WithConstLabels(prometheus.Labels{"app": "shop"}).
+			WithInstanceLabel("consumer", instance)
+		metricsRegistry.Register("lag", metrics.NewGauge())
+		metricsRegistry.Register("fetches", metrics.NewCounter())
+		metricsRegistry.Register("fetch_latency", metrics.NewTimer())
+		pClient.UpdatePrometheusMetricsOnce()
+		pClient.UpdatePrometheusMetricsOnce()
+	}
+
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("providers with distinct instance labels collided: %v", err)
+	}
+	for _, metric := range metrics {
+		var consumers []string
+		for _, series := range metric.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range series.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["app"] != "shop" {
+				t.Fatalf("%s lost the const labels: %v", metric.GetName(), labels)
+			}
+			consumers = append(consumers, labels["consumer"])
+		}
+		if !reflect.DeepEqual(consumers, []string{"orders", "payments"}) {
+			t.Fatalf("expected a series per consumer of %s, got %v", metric.GetName(), consumers)
+		}
+	}
+}
+
+func TestPrometheusFlushHooks(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	gm := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gm)
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	flushedCount := -1
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithBeforeFlush(func() {
+			gm.Update(7)
+		}).
+		WithAfterFlush(func(count int, err error) {
+			flushedCount = count
+		})
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if flushedCount != 2 {
+		t.Fatalf("after flush hook got count %d, expected 2", flushedCount)
+	}
+	metrics, _ := prometheusRegistry.Gather()
+	if value := metrics[1].GetMetric()[0].Gauge.GetValue(); value != 7 {
+		t.Fatalf("before flush hook value wasn't exported. Expected: 7, actual: %v", value)
+	}
+}
+
+func TestPrometheusAddRegisterer(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	pushRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		AddRegisterer(pushRegistry)
+	// the default registry already holds an identical gauge, which must be
+	// reused and registered with the push registry as well
+	prometheusRegistry.MustRegister(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "test",
+		Subsystem: "subsys",
+		Name:      "gauge",
+		Help:      "gauge",
+	}, []string{}))
+	gm := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gm)
+	metricsRegistry.Register("histogram", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	gm.Update(3)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	for _, registry := range []*prometheus.Registry{prometheusRegistry, pushRegistry} {
+		metrics, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("gather failed: %v", err)
+		}
+		if len(metrics) != 2 {
+			t.Fatalf("expected 2 metric families in every registry, got %d", len(metrics))
+		}
+	}
+	metrics, _ := pushRegistry.Gather()
+	if value := metrics[0].GetMetric()[0].Gauge.GetValue(); value != 3 {
+		t.Fatalf("Expected: 3, actual: %v", value)
+	}
+}
+
+func TestPrometheusAddRegistererError(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	pushRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var errs []error
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		AddRegisterer(pushRegistry).
+		WithErrorHandler(func(err error) {
+			errs = append(errs, err)
+		})
+	// the push registry holds a gauge of the same name with another help
+	pushRegistry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "test_subsys_gauge",
+		Help: "something else",
+	}))
+	gm := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gm)
+	gm.Update(3)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "added registerer") {
+		t.Fatalf("expected the added registerer's error to be reported, got %v", errs)
+	}
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].GetMetric()[0].GetGauge().GetValue() != 3 {
+		t.Fatalf("expected the gauge to be exported to the Prometheus registry, got %v", metrics)
+	}
+}
+
+func TestPrometheusEmptyBuckets(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var handled []error
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithErrorHandler(func(err error) {
+			handled = append(handled, err)
+		})
+	if err := pClient.Validate(); err != nil {
+		t.Fatalf("default config is invalid: %v", err)
+	}
+	if err := pClient.WithHistogramBuckets([]float64{0.9, 0.5}).Validate(); err == nil {
+		t.Fatalf("unsorted buckets passed validation")
+	}
+	if err := pClient.WithHistogramBuckets([]float64{}).Validate(); err == nil {
+		t.Fatalf("empty buckets passed validation")
+	}
+
+	metricsRegistry.Register("histogram", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	if err := pClient.UpdatePrometheusMetricsOnce(); err == nil {
+		t.Fatalf("flush didn't report the empty buckets")
+	}
+	if len(handled) != 1 {
+		t.Fatalf("expected 1 handled error, got %v", handled)
+	}
+	metrics, _ := prometheusRegistry.Gather()
+	for _, metric := range metrics {
+		if metric.GetType().String() == "HISTOGRAM" {
+			t.Fatalf("histogram without buckets was exported: %v", metric)
+		}
+	}
+}
+
+func TestPrometheusConstLabelsForMetric(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithConstLabels(prometheus.Labels{"app": "shop", "component": "none"}).
+		WithConstLabelsForMetric(`^auth\.`, prometheus.Labels{"component": "auth"}).
+		WithConstLabelsForMetric(`^db\.`, prometheus.Labels{"component": "db"})
+	metricsRegistry.Register("auth.logins", metrics.NewCounter())
+	metricsRegistry.Register("db.queries", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	metricsRegistry.Register("uptime", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	components := make(map[string]string)
+	for _, metric := range metrics {
+		labels := make(map[string]string)
+		for _, label := range metric.GetMetric()[0].GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if labels["app"] != "shop" {
+			t.Fatalf("global const labels weren't merged into %s: %v", metric.GetName(), labels)
+		}
+		components[metric.GetName()] = labels["component"]
+	}
+	expected := map[string]string{
+		"test_subsys_auth_logins":          "auth",
+		"test_subsys_db_queries_histogram": "db",
+		"test_subsys_uptime":               "none",
+	}
+	for name, component := range expected {
+		if components[name] != component {
+			t.Fatalf("Expected: %v, actual: %v", expected, components)
+		}
+	}
+}
+
+func TestPrometheusReset(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithNativeCounters(true)
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	metricsRegistry.Register("histogram", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	cntr.Inc(3)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if err := pClient.Reset(); err != nil {
+		t.Fatalf("reset failed: %v", err)
+	}
+	if metrics, _ := prometheusRegistry.Gather(); len(metrics) != 0 {
+		t.Fatalf("reset left metrics registered: %v", metrics)
+	}
+
+	if err := pClient.UpdatePrometheusMetricsOnce(); err != nil {
+		t.Fatalf("flush after reset failed: %v", err)
+	}
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("expected 3 metric families after reset, got %d", len(metrics))
+	}
+	if value := metrics[0].GetMetric()[0].Counter.GetValue(); value != 3 {
+		t.Fatalf("Expected: 3, actual: %v", value)
+	}
+}
+
+func TestPrometheusReconfigure(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithConstLabels(prometheus.Labels{"env": "prod"}).
+		WithHistogramBuckets([]float64{0.5, 0.9})
+	histogram := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	metricsRegistry.Register("histogram", histogram)
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	histogram.Update(10)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	flushing := make(chan struct{})
+	go func() {
+		defer close(flushing)
+		for i := 0; i < 100; i++ {
+			pClient.UpdatePrometheusMetricsOnce()
+		}
+	}()
+	err := pClient.Reconfigure(func(c *PrometheusConfig) {
+		c.WithConstLabels(prometheus.Labels{"env": "staging"}).
+			WithHistogramBuckets([]float64{0.99})
+	})
+	if err != nil {
+		t.Fatalf("reconfigure failed: %v", err)
+	}
+	<-flushing
+	pClient.UpdatePrometheusMetricsOnce()
+
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("expected 3 metric families, got %v", metrics)
+	}
+	for _, metric := range metrics {
+		series := metric.GetMetric()
+		if len(series) != 1 || series[0].GetLabel()[0].GetValue() != "staging" {
+			t.Fatalf("expected %s to be exported with the new const labels only, got %v", metric.GetName(), series)
+		}
+		if histogram := series[0].GetHistogram(); histogram != nil && len(histogram.GetBucket()) != 1 {
+			t.Fatalf("expected the new bucket only, got %v", histogram.GetBucket())
+		}
+	}
+}
+
+func TestPrometheusReconfigureLabelNames(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithConstLabels(prometheus.Labels{"env": "prod"})
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	if err := pClient.UpdatePrometheusMetricsOnce(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	err := pClient.Reconfigure(func(c *PrometheusConfig) {
+		c.WithConstLabels(prometheus.Labels{"env": "prod", "tenant": "acme"})
+	})
+	if err != nil {
+		t.Fatalf("reconfigure failed: %v", err)
+	}
+	err = pClient.UpdatePrometheusMetricsOnce()
+	if err == nil || !strings.Contains(err.Error(), "different label names") {
+		t.Fatalf("expected the registry to reject the new label name, got %v", err)
+	}
+
+	families, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(families) != 0 {
+		t.Fatalf("expected the gauge not to be exported, got %v", families)
+	}
+}
+
+func TestPrometheusMeterRateUnit(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithMeterRateUnit(time.Minute)
+	gm := metrics.NewMeter()
+	metricsRegistry.Register("meter", gm)
+	gm.Mark(30)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, _ := prometheusRegistry.Gather()
+
+	snapshot := gm.Snapshot()
+	metricValues := make(map[string]float64)
+	for _, metric := range metrics {
+		metricValues[metric.GetName()] = metric.GetMetric()[0].Gauge.GetValue()
+	}
+	if metricValues["test_subsys_meter_count"] != 30 {
+		t.Fatalf("meter count must not be converted, got %v", metricValues["test_subsys_meter_count"])
+	}
+	perMinute := metricValues["test_subsys_meter_rate_mean"]
+	if perMinute < snapshot.RateMean()*60*0.5 || perMinute > snapshot.RateMean()*60*2 {
+		t.Fatalf("rate wasn't converted to per minute: %v per minute vs %v per second", perMinute, snapshot.RateMean())
+	}
+}
+
+func TestPrometheusHistogramQuantileGauges(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithHistogramMode(ModeQuantileGauges).
+		WithHistogramBuckets([]float64{0.5, 0.99})
+	gm := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	metricsRegistry.Register("latency", gm)
+	for ii := 1; ii <= 100; ii++ {
+		gm.Update(int64(ii))
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, _ := prometheusRegistry.Gather()
+
+	metricValues := make(map[string]float64)
+	for _, metric := range metrics {
+		for _, series := range metric.GetMetric() {
+			name := metric.GetName()
+			for _, label := range series.GetLabel() {
+				name += fmt.Sprintf("{%s=%q}", label.GetName(), label.GetValue())
+			}
+			metricValues[name] = series.Gauge.GetValue()
+		}
+	}
+	snapshot := gm.Snapshot()
+	expectedValues := map[string]float64{
+		`test_subsys_latency{quantile="0.5"}`:  snapshot.Percentile(0.5),
+		`test_subsys_latency{quantile="0.99"}`: snapshot.Percentile(0.99),
+		"test_subsys_latency_count":            100,
+		"test_subsys_latency_sum":              5050,
+	}
+	if !reflect.DeepEqual(metricValues, expectedValues) {
+		t.Fatalf("Expected: %v, actual: %v", expectedValues, metricValues)
+	}
+}
+
+func TestPrometheusValidateBuckets(t *testing.T) {
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+	invalid := map[string][]float64{
+		"unsorted":  {0.5, 0.9, 0.75},
+		"duplicate": {0.5, 0.9, 0.9, 0.99},
+		"NaN":       {0.5, math.NaN(), 0.99},
+	}
+	for name, buckets := range invalid {
+		if err := pClient.WithHistogramBuckets([]float64{0.5}).WithTimerBuckets(buckets).Validate(); err == nil {
+			t.Fatalf("%s timer buckets passed validation", name)
+		}
+		if err := pClient.WithTimerBuckets([]float64{0.5}).WithHistogramBuckets(buckets).Validate(); err == nil {
+			t.Fatalf("%s histogram buckets passed validation", name)
+		}
+	}
+	if err := pClient.WithHistogramBuckets([]float64{0.5, 0.9}).WithTimerBuckets([]float64{0.9, 0.99}).Validate(); err != nil {
+		t.Fatalf("valid buckets failed validation: %v", err)
+	}
+}
+
+func TestPrometheusHistogramCollectorIsChecked(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	metricsRegistry.Register("metric", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	pClient.UpdatePrometheusMetricsOnce()
+
+	conflicting := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "test",
+		Subsystem: "subsys",
+		Name:      "metric_histogram",
+		Help:      "a different help text",
+	})
+	if err := prometheusRegistry.Register(conflicting); err == nil {
+		t.Fatalf("descriptor conflict with the histogram wasn't detected at registration")
+	}
+
+	// a second provider exporting the identical histogram reuses the collector
+	otherClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	otherClient.UpdatePrometheusMetricsOnce()
+	if _, err := prometheusRegistry.Gather(); err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+}
+
+func TestPrometheusFlushDeadline(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var handled []error
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithFlushDeadline(5 * time.Millisecond).
+		WithErrorHandler(func(err error) {
+			handled = append(handled, err)
+		})
+	slow := func() int64 {
+		time.Sleep(10 * time.Millisecond)
+		return 1
+	}
+	metricsRegistry.Register("slow1", metrics.NewFunctionalGauge(slow))
+	metricsRegistry.Register("slow2", metrics.NewFunctionalGauge(slow))
+
+	if err := pClient.UpdatePrometheusMetricsOnce(); err == nil {
+		t.Fatalf("partial flush wasn't reported")
+	}
+	if len(handled) != 1 {
+		t.Fatalf("expected 1 handled error, got %v", handled)
+	}
+	if metrics, _ := prometheusRegistry.Gather(); len(metrics) != 1 {
+		t.Fatalf("expected 1 metric exported before the deadline, got %d", len(metrics))
+	}
+}
+
+func TestPrometheusAddGaugeFunc(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	hits := metrics.NewCounter()
+	misses := metrics.NewCounter()
+	metricsRegistry.Register("hits", hits)
+	metricsRegistry.Register("misses", misses)
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		AddGaugeFunc("hit_ratio", func() float64 {
+			return float64(hits.Count()) / float64(hits.Count()+misses.Count())
+		}, prometheus.Labels{"cache": "users"})
+	hits.Inc(3)
+	misses.Inc(1)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, _ := prometheusRegistry.Gather()
+
+	serialized := fmt.Sprint(metrics[0])
+	expected := `name:"test_subsys_hit_ratio" help:"hit_ratio" type:GAUGE metric:<label:<name:"cache" value:"users" > gauge:<value:0.75 > > `
+	if serialized != expected {
+		t.Fatalf("gauge func wasn't exported:\n+ %s\n- %s", serialized, expected)
+	}
+}
+
+func TestPrometheusLabelMismatchDoesNotPanic(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var handled []error
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLabelExtractor(func(name string) (string, prometheus.Labels) {
+			if parts := strings.SplitN(name, ".", 2); len(parts) == 2 {
+				return parts[0], prometheus.Labels{"region": parts[1]}
+			}
+			return name, nil
+		}).
+		WithErrorHandler(func(err error) {
+			handled = append(handled, err)
+		})
+	// both map to test_subsys_requests, one with and one without a label
+	metricsRegistry.Register("requests", metrics.NewGauge())
+	metricsRegistry.Register("requests.eu", metrics.NewGauge())
+
+	if err := pClient.UpdatePrometheusMetricsOnce(); err == nil {
+		t.Fatalf("label mismatch wasn't reported")
+	}
+	if len(handled) != 1 {
+		t.Fatalf("expected 1 handled error, got %v", handled)
+	}
+	metrics, _ := prometheusRegistry.Gather()
+	if len(metrics) != 1 || len(metrics[0].GetMetric()) != 1 {
+		t.Fatalf("expected the first label set to be exported, got %v", metrics)
+	}
+}
+
+func TestPrometheusRegistrationErrorDoesNotPanic(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var handled []error
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithErrorHandler(func(err error) {
+			handled = append(handled, err)
+		})
+	// % survives flattening and makes an invalid metric name
+	metricsRegistry.Register("cpu%", metrics.NewGauge())
+	metricsRegistry.Register("cpu", metrics.NewGauge())
+
+	err := pClient.UpdatePrometheusMetricsOnce()
+	if err == nil || !strings.Contains(err.Error(), "registering it failed") {
+		t.Fatalf("expected the registration error to be returned, got %v", err)
+	}
+	if len(handled) != 1 {
+		t.Fatalf("expected 1 handled error, got %v", handled)
+	}
+	metrics, _ := prometheusRegistry.Gather()
+	if len(metrics) != 1 || metrics[0].GetName() != "test_subsys_cpu" {
+		t.Fatalf("expected only the valid gauge to be exported, got %v", metrics)
+	}
+}
+
+func TestPrometheusTypeFilter(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	flushedCount := 0
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTypeFilter(func(metric interface{}) bool {
+			switch metric.(type) {
+			case metrics.Timer, metrics.Histogram:
+				return false
+			}
+			return true
+		}).
+		WithAfterFlush(func(count int, err error) {
+			flushedCount = count
+		})
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	metricsRegistry.Register("timer", metrics.NewTimer())
+	metricsRegistry.Register("histogram", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	pClient.UpdatePrometheusMetricsOnce()
+
+	metrics, _ := prometheusRegistry.Gather()
+	if len(metrics) != 1 || metrics[0].GetName() != "test_subsys_counter" {
+		t.Fatalf("expected only the counter to be exported, got %v", metrics)
+	}
+	if flushedCount != 1 {
+		t.Fatalf("filtered metrics were counted as exported: %d", flushedCount)
+	}
+}
+
+// mutatingRegistry presents a metric twice during Each, as a registry
+// modified mid-iteration might.
+type mutatingRegistry struct {
+	metrics.Registry
+}
+
+func (r mutatingRegistry) Each(f func(string, interface{})) {
+	first := metrics.NewGauge()
+	first.Update(1)
+	second := metrics.NewGauge()
+	second.Update(2)
+	f("gauge", first)
+	f("gauge", second)
+}
+
+func TestPrometheusDuplicateNamesInFlush(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	flushedCount := 0
+	pClient := NewPrometheusProvider(mutatingRegistry{metrics.NewRegistry()}, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithAfterFlush(func(count int, err error) {
+			flushedCount = count
+		})
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if flushedCount != 1 {
+		t.Fatalf("duplicate name was exported twice")
+	}
+	metrics, _ := prometheusRegistry.Gather()
+	if value := metrics[0].GetMetric()[0].Gauge.GetValue(); value != 1 {
+		t.Fatalf("first occurrence should win. Expected: 1, actual: %v", value)
+	}
+}
+
+func TestPrometheusMaxConsecutiveErrors(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	metricsRegistry.Register("histogram", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	flushes := 0
+	stopped := make(chan error, 1)
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 10*time.Millisecond).
+		WithHistogramBuckets([]float64{}).
+		WithAfterFlush(func(count int, err error) {
+			flushes++
+		}).
+		WithMaxConsecutiveErrors(3, func(err error) {
+			stopped <- err
+		})
+
+	done := make(chan struct{})
+	go func() {
+		pClient.UpdatePrometheusMetrics()
+		close(done)
+	}()
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Fatalf("stop callback got no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("flush loop didn't stop after repeated errors")
+	}
+	<-done
+	if flushes != 3 {
+		t.Fatalf("expected the loop to stop after 3 flushes, got %d", flushes)
+	}
+}
+
+func TestPrometheusMetadata(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithNativeCounters(true).
+		WithMetadata(map[string]MetricMeta{
+			"processed":  {Unit: "bytes", Type: KindCounter, Help: "Bytes processed"},
+			"queue_size": {Type: KindGauge},
+		})
+	processed := metrics.NewGauge()
+	metricsRegistry.Register("processed", processed)
+	metricsRegistry.Register("queue_size", metrics.NewCounter())
+	metricsRegistry.Register("other", metrics.NewCounter())
+	processed.Update(512)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, _ := prometheusRegistry.Gather()
+
+	exported := make(map[string]string)
+	for _, metric := range metrics {
+		exported[metric.GetName()] = metric.GetType().String() + " " + metric.GetHelp()
+	}
+	expected := map[string]string{
+		"test_subsys_processed_bytes": "COUNTER Bytes processed",
+		"test_subsys_queue_size":      "GAUGE queue_size",
+		"test_subsys_other":           "COUNTER other",
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+func TestPrometheusHistogramLabelVariants(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLabelExtractor(func(name string) (string, prometheus.Labels) {
+			parts := strings.SplitN(name, "-for-topic-", 2)
+			return parts[0], prometheus.Labels{"for_topic": parts[1]}
+		})
+	for _, topic := range []string{"orders", "payments", "users"} {
+		metricsRegistry.Register("batch-size-for-topic-"+topic, metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	var topics []string
+	for _, metric := range metrics {
+		if metric.GetName() != "test_subsys_batch_size_histogram" {
+			continue
+		}
+		for _, series := range metric.GetMetric() {
+			topics = append(topics, series.GetLabel()[0].GetValue())
+		}
+	}
+	if expected := []string{"orders", "payments", "users"}; !reflect.DeepEqual(topics, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, topics)
+	}
+}
+
+func TestPrometheusHistogramOneCollectorPerName(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLabelExtractor(func(name string) (string, prometheus.Labels) {
+			parts := strings.SplitN(name, "-for-broker-", 2)
+			return parts[0], prometheus.Labels{"for_broker": parts[1]}
+		})
+	for _, broker := range []string{"1", "2"} {
+		histogram := metrics.NewHistogram(metrics.NewUniformSample(1028))
+		histogram.Update(1)
+		metricsRegistry.Register("request-latency-in-ms-for-broker-"+broker, histogram)
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if len(pClient.customMetrics) != 1 {
+		t.Fatalf("expected 1 collector, got %d", len(pClient.customMetrics))
+	}
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	var series int
+	for _, metric := range metrics {
+		if metric.GetName() == "test_subsys_request_latency_in_ms_histogram" {
+			series = len(metric.GetMetric())
+		}
+	}
+	if series != 2 {
+		t.Fatalf("Expected: %v, actual: %v", 2, series)
+	}
+}
+
+func TestPrometheusPreRegister(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	counter := metrics.NewCounter()
+	metricsRegistry.Register("counter", counter)
+	metricsRegistry.Register("histogram", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	counter.Inc(3)
+	pClient.UpdatePrometheusMetricsOnce()
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+
+	if err := pClient.PreRegister(); err != nil {
+		t.Fatalf("pre-registration failed: %v", err)
+	}
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	exported := map[string]float64{}
+	for _, metric := range metrics {
+		if gauge := metric.GetMetric()[0].GetGauge(); gauge != nil {
+			exported[metric.GetName()] = gauge.GetValue()
+		} else {
+			exported[metric.GetName()] = float64(metric.GetMetric()[0].GetHistogram().GetSampleCount())
+		}
+	}
+	expected := map[string]float64{
+		"test_subsys_counter":             3,
+		"test_subsys_gauge":               0,
+		"test_subsys_histogram_histogram": 0,
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+func TestPrometheusPreRegisterDropZeroCounters(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithDropZeroCounters(true)
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+
+	if err := pClient.PreRegister(); err != nil {
+		t.Fatalf("pre-registration failed: %v", err)
+	}
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].GetName() != "test_subsys_gauge" {
+		t.Fatalf("Expected: %v, actual: %v", "test_subsys_gauge", metrics)
+	}
+}
+
+func TestPrometheusPreRegisterNameValidator(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithNameValidator(regexp.MustCompile(`_ok$`))
+	metricsRegistry.Register("gauge_ok", metrics.NewGauge())
+	metricsRegistry.Register("gauge_bad", metrics.NewGauge())
+
+	if err := pClient.PreRegister(); err == nil {
+		t.Fatal("expected the invalid name to be reported")
+	}
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].GetName() != "test_subsys_gauge_ok" {
+		t.Fatalf("Expected: %v, actual: %v", "test_subsys_gauge_ok", metrics)
+	}
+}
+
+func TestPrometheusTypeRules(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTypeRules([]TypeRule{
+			{Pattern: regexp.MustCompile(`^requests_`), Kind: KindCounter},
+			{Pattern: regexp.MustCompile(`_total$`), Kind: KindGauge},
+			{Pattern: regexp.MustCompile(`_total$`), Kind: KindCounter},
+		}).
+		WithMetadata(map[string]MetricMeta{"requests_pending": {Type: KindGauge}})
+	for _, name := range []string{"requests_served", "requests_pending", "errors_total", "queue_size"} {
+		metricsRegistry.Register(name, metrics.NewGauge())
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	exported := map[string]string{}
+	for _, metric := range metrics {
+		exported[metric.GetName()] = metric.GetType().String()
+	}
+	expected := map[string]string{
+		"test_subsys_requests_served":  "COUNTER",
+		"test_subsys_requests_pending": "GAUGE",
+		"test_subsys_errors_total":     "GAUGE",
+		"test_subsys_queue_size":       "GAUGE",
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+func TestPrometheusSuffixRules(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithSuffixRules(map[string]MetricKind{".count": KindCounter, "_errors.count": KindGauge, ".p99": KindGauge})
+	for _, name := range []string{"requests.count", "parse_errors.count", "latency.p99", "count"} {
+		metricsRegistry.Register(name, metrics.NewGauge())
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	exported := map[string]string{}
+	for _, metric := range metrics {
+		exported[metric.GetName()] = metric.GetType().String()
+	}
+	expected := map[string]string{
+		"test_subsys_requests": "COUNTER",
+		"test_subsys_parse":    "GAUGE",
+		"test_subsys_latency":  "GAUGE",
+		"test_subsys_count":    "GAUGE",
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+func TestPrometheusCounterTotalSuffixTypeChange(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithCounterTotalSuffix(true).
+		WithAutoCounterDetection(2)
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("count", gauge)
+
+	var exported []string
+	for _, val := range []int64{1, 2, 3, 1} {
+		gauge.Update(val)
+		pClient.UpdatePrometheusMetricsOnce()
+		metrics, err := prometheusRegistry.Gather()
+		if err != nil {
+			t.Fatalf("gather failed: %v", err)
+		}
+		var names []string
+		for _, metric := range metrics {
+			names = append(names, metric.GetName()+" "+metric.GetType().String())
+		}
+		exported = append(exported, strings.Join(names, ", "))
+	}
+	expected := []string{
+		"test_subsys_count GAUGE",
+		"test_subsys_count GAUGE",
+		"test_subsys_count_total COUNTER",
+		"test_subsys_count GAUGE",
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+func TestPrometheusCounterTotalSuffix(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithCounterTotalSuffix(true).
+		WithNativeCounters(true).
+		WithTimerMode(ModeCounterOnly)
+	metricsRegistry.Register("requests", metrics.NewCounter())
+	metricsRegistry.Register("errors.total", metrics.NewCounter())
+	metricsRegistry.Register("latency", metrics.NewTimer())
+	metricsRegistry.Register("queue", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	exported := map[string]string{}
+	for _, metric := range metrics {
+		exported[metric.GetName()] = metric.GetType().String()
+	}
+	expected := map[string]string{
+		"test_subsys_requests_total":      "COUNTER",
+		"test_subsys_errors_total":        "COUNTER",
+		"test_subsys_latency_count_total": "COUNTER",
+		"test_subsys_queue":               "GAUGE",
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+func TestPrometheusCounterKindForSomeCounters(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithMetadata(map[string]MetricMeta{"requests": {Type: KindCounter}})
+	requests := metrics.NewCounter()
+	connections := metrics.NewCounter()
+	metricsRegistry.Register("requests", requests)
+	metricsRegistry.Register("connections", connections)
+	requests.Inc(5)
+	connections.Inc(5)
+	pClient.UpdatePrometheusMetricsOnce()
+	requests.Inc(2)
+	connections.Dec(2)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	exported := map[string]string{}
+	for _, metric := range metrics {
+		series := metric.GetMetric()[0]
+		value := series.GetGauge().GetValue() + series.GetCounter().GetValue()
+		exported[metric.GetName()] = fmt.Sprintf("%s %v", metric.GetType(), value)
+	}
+	expected := map[string]string{
+		"test_subsys_requests":    "COUNTER 7",
+		"test_subsys_connections": "GAUGE 3",
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+	if requests.Count() != 7 {
+		t.Fatalf("expected the go-metrics counter to be left alone, got %d", requests.Count())
+	}
+}
+
+func TestPrometheusDeltaCounters(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithMetadata(map[string]MetricMeta{"sent": {Unit: "bytes"}}).
+		WithDeltaCounters([]string{"sent"})
+	sent := metrics.NewCounter()
+	connections := metrics.NewCounter()
+	metricsRegistry.Register("sent", sent)
+	metricsRegistry.Register("connections", connections)
+	sent.Inc(5)
+	connections.Inc(5)
+	pClient.UpdatePrometheusMetricsOnce()
+	sent.Inc(2)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	exported := map[string]string{}
+	for _, metric := range metrics {
+		series := metric.GetMetric()[0]
+		value := series.GetGauge().GetValue() + series.GetCounter().GetValue()
+		exported[metric.GetName()] = fmt.Sprintf("%s %v", metric.GetType(), value)
+	}
+	expected := map[string]string{
+		"test_subsys_sent_bytes":  "COUNTER 7",
+		"test_subsys_connections": "GAUGE 5",
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+func TestPrometheusDualCounterExport(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithDualCounterExport(true)
+	counter := metrics.NewCounter()
+	metricsRegistry.Register("requests", counter)
+	counter.Inc(2)
+	pClient.UpdatePrometheusMetricsOnce()
+	counter.Inc(3)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	exported := map[string]float64{}
+	for _, metric := range metrics {
+		if gauge := metric.GetMetric()[0].GetGauge(); gauge != nil {
+			exported[metric.GetName()+" gauge"] = gauge.GetValue()
+		} else {
+			exported[metric.GetName()+" counter"] = metric.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	expected := map[string]float64{
+		"test_subsys_requests gauge":         5,
+		"test_subsys_requests_total counter": 5,
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+func TestPrometheusHistogramStats(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithHistogramStats([]HistogramStat{StatMin, StatMax, StatMean, StatP50})
+	histogram := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	metricsRegistry.Register("size", histogram)
+	for _, v := range []int64{1, 2, 3, 4, 5} {
+		histogram.Update(v)
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	exported := map[string]float64{}
+	for _, metric := range metrics {
+		if gauge := metric.GetMetric()[0].GetGauge(); gauge != nil {
+			exported[metric.GetName()] = gauge.GetValue()
+		}
+	}
+	expected := map[string]float64{
+		"test_subsys_size":      5,
+		"test_subsys_size_min":  1,
+		"test_subsys_size_max":  5,
+		"test_subsys_size_mean": 3,
+		"test_subsys_size_p50":  3,
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+func TestPrometheusIsolatedProvider(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	pClient, prometheusRegistry := NewIsolatedProvider(metricsRegistry, "test", "subsys", 1*time.Second)
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].GetName() != "test_subsys_gauge" {
+		t.Fatalf("Expected: %v, actual: %v", "test_subsys_gauge", metrics)
+	}
+}
+
+func TestPrometheusSampleBucketsNegative(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithHistogramMode(ModeSampleBuckets).
+		WithHistogramBuckets([]float64{-10, -1, 0, 1, 10})
+	histogram := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	metricsRegistry.Register("clock_skew", histogram)
+	for _, v := range []int64{-20, -5, -1, 0, 3, 7} {
+		histogram.Update(v)
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	if len(metrics) != 2 || metrics[1].GetName() != "test_subsys_clock_skew_histogram" {
+		t.Fatalf("histogram wasn't exported: %v", metrics)
+	}
+	exported := metrics[1].GetMetric()[0].GetHistogram()
+	if exported.GetSampleCount() != 6 || exported.GetSampleSum() != -16 {
+		t.Fatalf("Expected: count 6 and sum -16, actual: count %v and sum %v", exported.GetSampleCount(), exported.GetSampleSum())
+	}
+	buckets := map[float64]uint64{}
+	for _, bucket := range exported.GetBucket() {
+		buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+	}
+	expected := map[float64]uint64{-10: 1, -1: 3, 0: 4, 1: 4, 10: 6}
+	if !reflect.DeepEqual(buckets, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, buckets)
+	}
+}
+
+func TestPrometheusHelpSuffix(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithDescriptions(map[string]string{"described": "A described gauge."}).
+		WithHelpSuffix(" (exported from go-metrics)")
+	metricsRegistry.Register("described", metrics.NewGauge())
+	metricsRegistry.Register("plain", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	exported := map[string]string{}
+	for _, metric := range metrics {
+		exported[metric.GetName()] = metric.GetHelp()
+	}
+	expected := map[string]string{
+		"test_subsys_described": "A described gauge. (exported from go-metrics)",
+		"test_subsys_plain":     "plain (exported from go-metrics)",
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+// snapshotCountingTimer counts the snapshots taken of a timer.
+type snapshotCountingTimer struct {
+	metrics.Timer
+	snapshots int
+}
+
+func (t *snapshotCountingTimer) Snapshot() metrics.Timer {
+	t.snapshots++
+	return t.Timer.Snapshot()
+}
+
+func TestPrometheusTimerSingleSnapshot(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	timer := &snapshotCountingTimer{Timer: metrics.NewTimer()}
+	metricsRegistry.Register("timer", timer)
+	timer.Update(time.Second)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if timer.snapshots != 1 {
+		t.Fatalf("Expected: %v, actual: %v", 1, timer.snapshots)
+	}
+}
+
+func TestPrometheusNameCase(t *testing.T) {
+	for nameCase, expected := range map[NameCase]string{
+		AsIs:  "Test_subsys_HTTPServer_ThreadCount",
+		Lower: "test_subsys_httpserver_threadcount",
+		Snake: "test_subsys_http_server_thread_count",
+	} {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		pClient := NewPrometheusProvider(metricsRegistry, "Test", "subsys", prometheusRegistry, 1*time.Second).
+			WithNameCase(nameCase)
+		metricsRegistry.Register("HTTPServer.ThreadCount", metrics.NewGauge())
+		pClient.UpdatePrometheusMetricsOnce()
+		metrics, err := prometheusRegistry.Gather()
+		if err != nil {
+			t.Fatalf("gather failed: %v", err)
+		}
+		if len(metrics) != 1 || metrics[0].GetName() != expected {
+			t.Fatalf("Expected: %v, actual: %v", expected, metrics)
+		}
+	}
+}
+
+func TestPrometheusSelfMetricsFlushes(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithSelfMetrics(true)
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	// the flushes counter follows go_metrics_prometheus_flush_skipped_total
+	if len(metrics) != 4 || metrics[1].GetName() != "go_metrics_prometheus_flushes_total" {
+		t.Fatalf("expected the flushes counter, got %v", metrics)
+	}
+	if flushes := metrics[1].GetMetric()[0].GetCounter().GetValue(); flushes != 2 {
+		t.Fatalf("Expected: %v, actual: %v", 2, flushes)
+	}
+}
+
+func TestPrometheusGaugeAndHistogramOpts(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithConstLabels(prometheus.Labels{"env": "prod"}).
+		WithDescriptions(map[string]string{"described": "A described gauge."}).
+		WithGaugeOpts(prometheus.GaugeOpts{
+			Help:        "A gauge.",
+			ConstLabels: prometheus.Labels{"env": "dev", "team": "infra"},
+		}).
+		WithHistogramDescOptions(prometheus.Opts{Help: "A histogram."})
+	metricsRegistry.Register("described", metrics.NewGauge())
+	metricsRegistry.Register("plain", metrics.NewGauge())
+	metricsRegistry.Register("sizes", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	exported := map[string]string{}
+	for _, metric := range metrics {
+		var labels []string
+		for _, label := range metric.GetMetric()[0].GetLabel() {
+			labels = append(labels, label.GetName()+"="+label.GetValue())
+		}
+		exported[metric.GetName()] = metric.GetHelp() + " " + strings.Join(labels, ",")
+	}
+	expected := map[string]string{
+		"test_subsys_described":       "A described gauge. env=prod,team=infra",
+		"test_subsys_plain":           "A gauge. env=prod,team=infra",
+		"test_subsys_sizes_histogram": "A histogram. env=prod",
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+func TestPrometheusDescCustomizer(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithConstLabels(prometheus.Labels{"env": "prod"}).
+		WithDescCustomizer(func(name string, params DescParams) DescParams {
+			variableLabels := prometheus.Labels{"source": name}
+			for labelName, labelValue := range params.VariableLabels {
+				variableLabels[labelName] = labelValue
+			}
+			params.FQName = strings.TrimSuffix(params.FQName, "_histogram") + "_distribution"
+			params.VariableLabels = variableLabels
+			params.ConstLabels = nil
+			return params
+		})
+	metricsRegistry.Register("sizes", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	exported := map[string]string{}
+	for _, metric := range metrics {
+		var labels []string
+		for _, label := range metric.GetMetric()[0].GetLabel() {
+			labels = append(labels, label.GetName()+"="+label.GetValue())
+		}
+		exported[metric.GetName()] = strings.Join(labels, ",")
+	}
+	expected := map[string]string{"test_subsys_sizes_distribution": "source=sizes"}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+func TestPrometheusTimerCompactSummary(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTimerMode(ModeCompactSummary).
+		WithTimerUnit(time.Second).
+		WithTimerBuckets([]float64{0.5, 0.99})
+	timer := metrics.NewTimer()
+	metricsRegistry.Register("request", timer)
+	timer.Update(1 * time.Second)
+	timer.Update(3 * time.Second)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	if len(metrics) != 1 || metrics[0].GetName() != "test_subsys_request" {
+		t.Fatalf("expected only the summary, got %v", metrics)
+	}
+	summary := metrics[0].GetMetric()[0].GetSummary()
+	if summary.GetSampleCount() != 2 || summary.GetSampleSum() != 4 {
+		t.Fatalf("Expected: count 2 and sum 4, actual: count %v and sum %v", summary.GetSampleCount(), summary.GetSampleSum())
+	}
+	quantiles := map[float64]float64{}
+	for _, quantile := range summary.GetQuantile() {
+		quantiles[quantile.GetQuantile()] = quantile.GetValue()
+	}
+	if expected := map[float64]float64{0.5: 2, 0.99: 3}; !reflect.DeepEqual(quantiles, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, quantiles)
+	}
+}
+
+func TestPrometheusRegistrySnapshot(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := &lockingRegistry{Registry: metrics.NewRegistry()}
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithRegistrySnapshot(true).
+		WithTypeFilter(func(metric interface{}) bool {
+			// registering while the locking registry is iterated deadlocks
+			// unless the provider iterates over a snapshot
+			metricsRegistry.GetOrRegister("registered_during_flush", metrics.NewGauge())
+			return true
+		})
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].GetName() != "test_subsys_gauge" {
+		t.Fatalf("Expected: %v, actual: %v", "test_subsys_gauge", metrics)
+	}
+}
+
+func TestPrometheusWrappedConstLabels(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gauge)
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithWrappedConstLabels(prometheus.Labels{"app": "x"})
+	gauge.Update(1)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	// a provider replacing the first one takes over its already registered
+	// gauge
+	otherClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithWrappedConstLabels(prometheus.Labels{"app": "x"})
+	gauge.Update(2)
+	otherClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	if len(metrics) != 1 || len(metrics[0].GetMetric()) != 1 {
+		t.Fatalf("expected a single series, got %v", metrics)
+	}
+	series := metrics[0].GetMetric()[0]
+	if label := series.GetLabel()[0]; label.GetName() != "app" || label.GetValue() != "x" {
+		t.Fatalf("Expected: %v, actual: %v", `app="x"`, label)
+	}
+	if series.GetGauge().GetValue() != 2 {
+		t.Fatalf("Expected: %v, actual: %v", 2, series.GetGauge().GetValue())
+	}
+}
+
+func TestPrometheusWrappedConstLabelsForeignCollector(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var errs []error
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithWrappedConstLabels(prometheus.Labels{"app": "x"}).
+		WithErrorHandler(func(err error) {
+			errs = append(errs, err)
+		})
+	// another collector with the same descriptor, which the provider must
+	// not take over
+	prometheusRegistry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "test_subsys_gauge",
+		Help:        "gauge",
+		ConstLabels: prometheus.Labels{"app": "x"},
+	}, func() float64 { return 7 }))
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gauge)
+	gauge.Update(1)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if len(errs) != 1 {
+		t.Fatalf("expected the registration error to be reported, got %v", errs)
+	}
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].GetMetric()[0].GetGauge().GetValue() != 7 {
+		t.Fatalf("expected the other collector to stay registered, got %v", metrics)
+	}
+}
+
+func TestPrometheusExportMetric(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithConstLabels(prometheus.Labels{"app": "batch"}).
+		WithTypeFilter(func(metric interface{}) bool {
+			_, isMeter := metric.(metrics.Meter)
+			return !isMeter
+		})
+	processed := metrics.NewGauge()
+	pending := metrics.NewGauge()
+	metricsRegistry.Register("processed", processed)
+	metricsRegistry.Register("pending", pending)
+	metricsRegistry.Register("meter", metrics.NewMeter())
+	processed.Update(1)
+	pending.Update(1)
+	pClient.UpdatePrometheusMetricsOnce()
+	processed.Update(2)
+	pending.Update(2)
+	if err := pClient.ExportMetric("processed"); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+
+	if value, _ := pClient.LastValueWith("processed", nil); value != 2 {
+		t.Fatalf("Expected: 2, actual: %v", value)
+	}
+	if value, _ := pClient.LastValueWith("pending", nil); value != 1 {
+		t.Fatalf("Expected pending to stay at 1, actual: %v", value)
+	}
+	if err := pClient.ExportMetric("meter"); err == nil || !strings.Contains(err.Error(), "filtered by type") {
+		t.Fatalf("expected the filtered meter not to be exported, got %v", err)
+	}
+	if err := pClient.ExportMetric("missing"); err == nil {
+		t.Fatal("expected an error exporting a missing metric")
+	}
+}
+
+func TestPrometheusExportMetricLikeFlush(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	histogram := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	metricsRegistry.Register("histogram", histogram)
+	histogram.Update(1)
+	if err := pClient.ExportMetric("histogram"); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	families, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	for _, metric := range families {
+		if series := metric.GetMetric()[0]; series.TimestampMs != nil {
+			t.Fatalf("expected %s without timestamp like after a flush, got %v", metric.GetName(), series.GetTimestampMs())
+		}
+	}
+
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gauge)
+	gauge.Update(1)
+	pClient.Pause()
+	if err := pClient.ExportMetric("gauge"); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	if _, exported := pClient.LastValue("gauge"); exported {
+		t.Fatal("expected nothing to be exported while paused")
+	}
+}
+
+func TestPrometheusSkippedMetrics(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTypeFilter(func(metric interface{}) bool {
+			_, isMeter := metric.(metrics.Meter)
+			return !isMeter
+		})
+	metricsRegistry.Register("requests.served", metrics.NewGauge())
+	metricsRegistry.Register("meter", metrics.NewMeter())
+	metricsRegistry.Register("healthcheck", metrics.NewHealthcheck(func(metrics.Healthcheck) {}))
+	pClient.UpdatePrometheusMetricsOnce()
+	metricsRegistry.Register("requests-served", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+
+	expected := map[string]string{
+		"meter":           "filtered by type",
+		"healthcheck":     "unsupported type *metrics.StandardHealthcheck",
+		"requests-served": "name collides with requests.served",
+	}
+	if skipped := pClient.SkippedMetrics(); !reflect.DeepEqual(skipped, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, skipped)
+	}
+}
+
+func TestPrometheusPanickingFunctionalGauge(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var handled []error
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithErrorHandler(func(err error) {
+			handled = append(handled, err)
+		}).
+		AddGaugeFunc("panicking_func", func() float64 {
+			panic("gauge func")
+		}, nil)
+	metricsRegistry.Register("panicking", metrics.NewFunctionalGauge(func() int64 {
+		var sizes map[string]int64
+		sizes["a"] = 1
+		return sizes["a"]
+	}))
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+
+	if err := pClient.UpdatePrometheusMetricsOnce(); err == nil {
+		t.Fatalf("panic wasn't reported")
+	}
+	if len(handled) != 2 {
+		t.Fatalf("expected 2 handled errors, got %v", handled)
+	}
+	families, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if len(families) != 1 || families[0].GetName() != "test_subsys_gauge" {
+		t.Fatalf("Expected: %v, actual: %v", "test_subsys_gauge", families)
+	}
+
+	// a functional gauge panicking only once it's updated directly, see
+	// fastPath
+	metricsRegistry = metrics.NewRegistry()
+	handled = nil
+	pClient = NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		WithErrorHandler(func(err error) {
+			handled = append(handled, err)
+		})
+	flushes := 0
+	metricsRegistry.Register("panicking", metrics.NewFunctionalGauge(func() int64 {
+		flushes++
+		if flushes == 1 {
+			return 1
+		}
+		var sizes map[string]int64
+		sizes["a"] = 1
+		return sizes["a"]
+	}))
+
+	for i := 0; i < 3; i++ {
+		pClient.UpdatePrometheusMetricsOnce()
+	}
+	if len(handled) != 2 || !strings.Contains(handled[0].Error(), "panicked") {
+		t.Fatalf("expected 2 panics to be reported, got %v", handled)
+	}
+	if value, _ := pClient.LastValue("panicking"); value != 1 {
+		t.Fatalf("Expected: 1, actual: %v", value)
+	}
+}
+
+func TestPrometheusCollisionSuffix(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	renames := map[string]string{}
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithCollisionPolicy(Suffix, func(name string, exportedName string) {
+			renames[name] = exportedName
+		})
+	dotted, dashed := metrics.NewGauge(), metrics.NewGauge()
+	dotted.Update(1)
+	dashed.Update(2)
+	metricsRegistry.Register("requests.served", dotted)
+	pClient.UpdatePrometheusMetricsOnce()
+	metricsRegistry.Register("requests-served", dashed)
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+
+	expectedRenames := map[string]string{"requests-served": "requests_served_4d45056b"}
+	if !reflect.DeepEqual(renames, expectedRenames) {
+		t.Fatalf("Expected: %v, actual: %v", expectedRenames, renames)
+	}
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	exported := map[string]float64{}
+	for _, metric := range metrics {
+		exported[metric.GetName()] = metric.GetMetric()[0].GetGauge().GetValue()
+	}
+	expected := map[string]float64{
+		"test_subsys_requests_served":          1,
+		"test_subsys_requests_served_4d45056b": 2,
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+func TestPrometheusHistogramWithoutSampleGauge(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithHistogramSampleGauge(false)
+	gm := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	metricsRegistry.Register("metric", gm)
+	gm.Update(10)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	if len(metrics) != 1 || metrics[0].GetName() != "test_subsys_metric_histogram" {
+		t.Fatalf("expected only the histogram, got %v", metrics)
+	}
+}
+
+func TestPrometheusUpdateAtTimestamp(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithHistogramSampleGauge(false)
+	metricsRegistry.Register("metric", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	captured := time.Unix(1500000000, 0)
+	pClient.UpdatePrometheusMetricsAt(captured)
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	if len(metrics) != 1 {
+		t.Fatalf("expected only the histogram, got %v", metrics)
+	}
+	if timestamp := metrics[0].GetMetric()[0].GetTimestampMs(); timestamp != 1500000000000 {
+		t.Fatalf("Expected: %v, actual: %v", 1500000000000, timestamp)
+	}
+}
+
+func TestPrometheusAutoCounterDetection(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithAutoCounterDetection(2)
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("count", gauge)
+	exportedType := func() string {
+		metrics, err := prometheusRegistry.Gather()
+		if err != nil {
+			t.Fatalf("gather failed: %v", err)
+		}
+		if len(metrics) != 1 {
+			t.Fatalf("expected 1 metric, got %v", metrics)
+		}
+		return metrics[0].GetType().String()
+	}
+
+	var types []string
+	for _, val := range []int64{1, 2, 3, 4, 2, 3} {
+		gauge.Update(val)
+		pClient.UpdatePrometheusMetricsOnce()
+		types = append(types, exportedType())
+	}
+	expected := []string{"GAUGE", "GAUGE", "COUNTER", "COUNTER", "GAUGE", "GAUGE"}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, types)
+	}
+}
+
+func TestPrometheusAutoCounterDetectionLabelled(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLabelExtractor(func(name string) (string, prometheus.Labels) {
+			parts := strings.SplitN(name, "-for-topic-", 2)
+			return parts[0], prometheus.Labels{"topic": parts[1]}
+		}).
+		WithAutoCounterDetection(2)
+	a, b := metrics.NewGauge(), metrics.NewGauge()
+	metricsRegistry.Register("count-for-topic-a", a)
+	metricsRegistry.Register("count-for-topic-b", b)
+
+	var types []string
+	for i, val := range []int64{1, 2, 3, 4, 5, 6} {
+		a.Update(val)
+		// b decreases once, after a is already monotonic
+		if i == 2 {
+			b.Update(0)
+		} else {
+			b.Update(val)
+		}
+		pClient.UpdatePrometheusMetricsOnce()
+		metrics, err := prometheusRegistry.Gather()
+		if err != nil {
+			t.Fatalf("gather failed: %v", err)
+		}
+		if len(metrics) != 1 || len(metrics[0].GetMetric()) != 2 {
+			t.Fatalf("expected 1 metric with 2 series, got %v", metrics)
+		}
+		types = append(types, metrics[0].GetType().String())
+	}
+	expected := []string{"GAUGE", "GAUGE", "GAUGE", "GAUGE", "COUNTER", "COUNTER"}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, types)
+	}
+}
+
+func TestPrometheusLabelKeyRename(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLabelExtractor(func(name string) (string, prometheus.Labels) {
+			parts := strings.SplitN(name, "-for-broker-", 2)
+			return parts[0], prometheus.Labels{"for_broker": parts[1]}
+		}).
+		WithLabelKeyRename(map[string]string{"for_broker": "broker"})
+	if err := pClient.Validate(); err != nil {
+		t.Fatalf("valid rename failed validation: %v", err)
+	}
+	metricsRegistry.Register("requests-for-broker-1", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	label := metrics[0].GetMetric()[0].GetLabel()[0]
+	if label.GetName() != "broker" || label.GetValue() != "1" {
+		t.Fatalf("Expected: %v, actual: %v", `broker="1"`, label)
+	}
+	for _, invalid := range []string{"__name__", "1broker", "broker-id"} {
+		if err := pClient.WithLabelKeyRename(map[string]string{"for_broker": invalid}).Validate(); err == nil {
+			t.Fatalf("rename to %q passed validation", invalid)
+		}
+	}
+}
+
+func TestPrometheusFastPathMatchesGeneralPath(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	counter, gauge, gaugeFloat := metrics.NewCounter(), metrics.NewGauge(), metrics.NewGaugeFloat64()
+	metricsRegistry.Register("requests-for-topic-a", counter)
+	metricsRegistry.Register("queue-for-topic-a", gauge)
+	metricsRegistry.Register("load-for-topic-b", gaugeFloat)
+	metricsRegistry.Register("state-for-topic-a", metrics.NewGauge())
+	metricsRegistry.Register("histogram-for-topic-a", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	gather := func(fastPath bool) string {
+		prometheusRegistry := prometheus.NewRegistry()
+		pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+			WithLabelExtractor(func(name string) (string, prometheus.Labels) {
+				parts := strings.SplitN(name, "-for-topic-", 2)
+				return parts[0], prometheus.Labels{"for_topic": parts[1]}
+			}).
+			WithMetadata(map[string]MetricMeta{"load-for-topic-b": {Unit: "ratio"}}).
+			WithStateMapping("state", map[int]string{0: "off", 1: "on"})
+		pClient.noFastPath = !fastPath
+		for i := int64(0); i < 3; i++ {
+			counter.Inc(i)
+			gauge.Update(i)
+			gaugeFloat.Update(float64(i) / 2)
+			pClient.UpdatePrometheusMetricsOnce()
+		}
+		metrics, err := prometheusRegistry.Gather()
+		if err != nil {
+			t.Fatalf("gather failed: %v", err)
+		}
+		return fmt.Sprint(metrics)
+	}
+
+	general := gather(false)
+	counter.Clear()
+	gauge.Update(0)
+	gaugeFloat.Update(0)
+	if fast := gather(true); fast != general {
+		t.Fatalf("Expected: %v, actual: %v", general, fast)
+	}
+}
+
+func TestPrometheusPercentileMethod(t *testing.T) {
+	for method, expected := range map[PercentileMethod]map[string]float64{
+		Interpolated: {"0.5": 5.5, "0.9": 9.9},
+		NearestRank:  {"0.5": 5, "0.9": 9},
+	} {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+			WithHistogramMode(ModeQuantileGauges).
+			WithHistogramBuckets([]float64{0.5, 0.9}).
+			WithPercentileMethod(method)
+		histogram := metrics.NewHistogram(metrics.NewUniformSample(1028))
+		metricsRegistry.Register("size", histogram)
+		for v := int64(10); v > 0; v-- {
+			histogram.Update(v)
+		}
+		pClient.UpdatePrometheusMetricsOnce()
+		metrics, err := prometheusRegistry.Gather()
+		if err != nil {
+			t.Fatalf("gather failed: %v", err)
+		}
+
+		quantiles := map[string]float64{}
+		for _, metric := range metrics {
+			if metric.GetName() != "test_subsys_size" {
+				continue
+			}
+			for _, series := range metric.GetMetric() {
+				quantiles[series.GetLabel()[0].GetValue()] = series.GetGauge().GetValue()
+			}
+		}
+		if !reflect.DeepEqual(quantiles, expected) {
+			t.Fatalf("Expected: %v, actual: %v", expected, quantiles)
+		}
+	}
+}
+
+func TestPrometheusSourceNameLabel(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithSourceNameLabel("source_name")
+	metricsRegistry.Register("requests.served", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	label := metrics[0].GetMetric()[0].GetLabel()[0]
+	if label.GetName() != "source_name" || label.GetValue() != "requests.served" {
+		t.Fatalf("Expected: %v, actual: %v", `source_name="requests.served"`, label)
+	}
+}
+
+// flakyRegistry fails the first failures registrations.
+type flakyRegistry struct {
+	*prometheus.Registry
+	failures int
+}
+
+func (r *flakyRegistry) Register(collector prometheus.Collector) error {
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("registry busy")
+	}
+	return r.Registry.Register(collector)
+}
+
+func TestPrometheusRegistrationBackoff(t *testing.T) {
+	prometheusRegistry := &flakyRegistry{Registry: prometheus.NewRegistry(), failures: 2}
+	metricsRegistry := metrics.NewRegistry()
+	var errs []error
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithRegistrationBackoff(3).
+		WithErrorHandler(func(err error) {
+			errs = append(errs, err)
+		})
+	metricsRegistry.Register("counter", metrics.NewCounter())
+
+	// the attempts of flushes 1 and 2 fail, flush 3 waits, flush 4 registers
+	for flush := 1; flush <= 4; flush++ {
+		pClient.UpdatePrometheusMetricsOnce()
+		families, _ := prometheusRegistry.Gather()
+		if exported := len(families) == 1; exported != (flush == 4) {
+			t.Fatalf("flush %d: exported: %v", flush, exported)
+		}
+	}
+	if len(errs) != 0 {
+		t.Fatalf("Expected no errors, got: %v", errs)
+	}
+
+	prometheusRegistry.failures = 3
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	for flush := 0; flush < 8; flush++ {
+		pClient.UpdatePrometheusMetricsOnce()
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "registry busy") {
+		t.Fatalf("Expected one registration error, got: %v", errs)
+	}
+}
+
+// bigHistogram is a histogram with a count beyond the histograms go-metrics
+// can hold in a test.
+type bigHistogram struct {
+	metrics.Histogram
+	count int64
+}
+
+func (h bigHistogram) Count() int64 { return h.count }
+
+func (h bigHistogram) Snapshot() metrics.Histogram {
+	return bigHistogram{h.Histogram.Snapshot(), h.count}
+}
+
+func TestPrometheusIntegerCounts(t *testing.T) {
+	const count = 1<<53 - 1
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithNativeCounters(true)
+	counter := metrics.NewCounter()
+	metricsRegistry.Register("counter", counter)
+	metricsRegistry.Register("histogram", bigHistogram{metrics.NewHistogram(metrics.NewUniformSample(10)), count + 2})
+
+	counter.Inc(count - 1)
+	pClient.UpdatePrometheusMetricsOnce()
+	counter.Inc(1)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	if exported := metrics[0].GetMetric()[0].GetCounter().GetValue(); exported != count {
+		t.Fatalf("Expected counter: %d, actual: %f", count, exported)
+	}
+	if exported := metrics[1].GetMetric()[0].GetHistogram().GetSampleCount(); exported != count+2 {
+		t.Fatalf("Expected histogram count: %d, actual: %d", count+2, exported)
+	}
+}
+
+func TestPrometheusInitialFlush(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, time.Hour).
+		WithInitialFlush(true)
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	go pClient.UpdatePrometheusMetrics()
+
+	for attempt := 0; attempt < 100; attempt++ {
+		if metrics, _ := prometheusRegistry.Gather(); len(metrics) == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected the counter to be exported before the first FlushInterval passed")
+}
+
+func TestPrometheusBuildInfo(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	if err := pClient.SetBuildInfo(prometheus.Labels{"version": "1.0.0"}); err != nil {
+		t.Fatalf("SetBuildInfo failed: %v", err)
+	}
+	if err := pClient.SetBuildInfo(prometheus.Labels{"version": "1.0.1"}); err != nil {
+		t.Fatalf("SetBuildInfo failed: %v", err)
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	serialized := fmt.Sprint(metrics)
+	expected := `[name:"test_subsys_build_info" help:"Build information of the application, the value is always 1." type:GAUGE metric:<label:<name:"version" value:"1.0.1" > gauge:<value:1 > > ]`
+	if serialized != expected {
+		t.Fatalf("Expected: %s, actual: %s", expected, serialized)
+	}
+}
+
+func TestPrometheusSelfMetricsFlushDurations(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithSelfMetrics(true)
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	metricsRegistry.Register("timer", metrics.NewTimer())
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	var metricTypes []string
+	for _, metric := range metrics {
+		if metric.GetName() != "go_metrics_prometheus_flush_duration_seconds" {
+			continue
+		}
+		for _, series := range metric.GetMetric() {
+			metricTypes = append(metricTypes, series.GetLabel()[0].GetValue())
+		}
+	}
+	if !reflect.DeepEqual(metricTypes, []string{"counter", "timer"}) {
+		t.Fatalf("Expected: %v, actual: %v", []string{"counter", "timer"}, metricTypes)
+	}
+}
+
+func TestPrometheusSelfMetricsPrefix(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	for _, prefix := range []string{"kafka_exporter", "redis_exporter"} {
+		pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheusRegistry, 1*time.Second).
+			WithSelfMetrics(true).
+			WithSelfMetricsPrefix(prefix)
+		pClient.UpdatePrometheusMetricsOnce()
+	}
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	if len(metrics) != 8 || metrics[1].GetName() != "kafka_exporter_flushes_total" || metrics[5].GetName() != "redis_exporter_flushes_total" {
+		t.Fatalf("expected a flushes counter per provider, got %v", metrics)
+	}
+}
+
+func TestPrometheusSelfMetricsInvalidPrefix(t *testing.T) {
+	var errs []error
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		WithSelfMetrics(true).
+		WithSelfMetricsPrefix("kafka-exporter").
+		WithErrorHandler(func(err error) {
+			errs = append(errs, err)
+		})
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if len(errs) == 0 || !strings.Contains(errs[0].Error(), "self-metrics") {
+		t.Fatalf("expected the self-metrics' registration errors to be reported, got %v", errs)
+	}
+}
+
+func TestPrometheusSelfMetricsInfo(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "shop", "orders", prometheusRegistry, 5*time.Second).
+		WithSelfMetrics(true)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	// the info gauge follows go_metrics_prometheus_flushes_total
+	info := metrics[2]
+	if info.GetName() != "go_metrics_prometheus_info" || info.GetMetric()[0].GetGauge().GetValue() != 1 {
+		t.Fatalf("expected the info gauge, got %v", info)
+	}
+	labels := make(map[string]string)
+	for _, label := range info.GetMetric()[0].GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	expected := map[string]string{"namespace": "shop", "subsystem": "orders", "flush_interval": "5s"}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, labels)
+	}
+}
+
+func TestPrometheusSlowFlushSkipsTicks(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	var slow int32 = 1
+	var flushes int32
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheusRegistry, 40*time.Millisecond).
+		WithSelfMetrics(true).
+		WithBeforeFlush(func() {
+			if atomic.LoadInt32(&slow) == 1 {
+				atomic.AddInt32(&flushes, 1)
+				time.Sleep(130 * time.Millisecond)
+			}
+		})
+	go pClient.UpdatePrometheusMetrics()
+	time.Sleep(600 * time.Millisecond)
+	atomic.StoreInt32(&slow, 0)
+
+	// flushes of queued ticks would start right after the last, at 40, 170,
+	// 300, 430 and 560ms, rather than on the next tick at 40, 200, 360 and
+	// 520ms
+	if flushed := atomic.LoadInt32(&flushes); flushed > 4 {
+		t.Fatalf("Expected at most 4 slow flushes, got %d", flushed)
+	}
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	for _, metric := range metrics {
+		if metric.GetName() == "go_metrics_prometheus_flush_skipped_total" && metric.GetMetric()[0].GetCounter().GetValue() > 0 {
+			return
+		}
+	}
+	t.Fatalf("Expected skipped ticks to be counted, got %v", metrics)
+}
+
+func TestPrometheusLastValue(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		WithLabelExtractor(func(name string) (string, prometheus.Labels) {
+			parts := strings.SplitN(name, "-for-topic-", 2)
+			if len(parts) == 1 {
+				return name, nil
+			}
+			return parts[0], prometheus.Labels{"for_topic": parts[1]}
+		})
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("in.flight", gauge)
+	metricsRegistry.Register("records-for-topic-a", metrics.NewGauge())
+	metricsRegistry.Register("requests", metrics.NewMeter())
+
+	if _, ok := pClient.LastValue("in.flight"); ok {
+		t.Fatalf("Expected no value before the first flush")
+	}
+	for _, value := range []int64{3, 5} {
+		gauge.Update(value)
+		pClient.UpdatePrometheusMetricsOnce()
+		if exported, ok := pClient.LastValue("in.flight"); !ok || exported != float64(value) {
+			t.Fatalf("Expected: %v, actual: %v", value, exported)
+		}
+	}
+	if _, ok := pClient.LastValueWith("records", prometheus.Labels{"for_topic": "a"}); !ok {
+		t.Fatalf("Expected the value of a labelled series")
+	}
+	if _, ok := pClient.LastValue("requests_rate1"); !ok {
+		t.Fatalf("Expected the value of a meter's rate")
+	}
+}
+
+func TestPrometheusValueRounding(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithValueRounding(2)
+	ratio := metrics.NewGaugeFloat64()
+	metricsRegistry.Register("ratio", ratio)
+	ratio.Update(0.1 + 0.2)
+	pClient.UpdatePrometheusMetricsOnce()
+	if value, _ := pClient.LastValue("ratio"); value != 0.3 {
+		t.Fatalf("Expected: 0.3, actual: %v", value)
+	}
+	ratio.Update(2.0 / 3)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	if value := metrics[0].GetMetric()[0].GetGauge().GetValue(); value != 0.67 {
+		t.Fatalf("Expected: 0.67, actual: %v", value)
+	}
+}
+
+func TestPrometheusRawObservationsThreshold(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithRawObservationsThreshold(2).
+		WithTimerMode(ModeCompactSummary).
+		WithTimerUnit(time.Millisecond)
+	histogram := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	timer := NewSampledTimer(metrics.NewUniformSample(1028))
+	metricsRegistry.Register("payload", histogram)
+	metricsRegistry.Register("latency", timer)
+	histogram.Update(5)
+	histogram.Update(7)
+	timer.Update(3 * time.Millisecond)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	observations := make(map[string]float64)
+	for _, metric := range metrics {
+		if !strings.HasSuffix(metric.GetName(), "_observation") {
+			t.Fatalf("expected only observations, got %s", metric.GetName())
+		}
+		for _, series := range metric.GetMetric() {
+			observations[fmt.Sprintf("%s{index=%q}", metric.GetName(), series.GetLabel()[0].GetValue())] = series.GetGauge().GetValue()
+		}
+	}
+	expected := map[string]float64{
+		`test_subsys_payload_observation{index="0"}`: 5,
+		`test_subsys_payload_observation{index="1"}`: 7,
+		`test_subsys_latency_observation{index="0"}`: 3,
+	}
+	if !reflect.DeepEqual(observations, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, observations)
+	}
+
+	histogram.Update(9)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err = prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	var names []string
+	for _, metric := range metrics {
+		names = append(names, metric.GetName())
+	}
+	expectedNames := []string{"test_subsys_latency_observation", "test_subsys_payload", "test_subsys_payload_histogram"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Fatalf("Expected: %v, actual: %v", expectedNames, names)
+	}
+}
+
+func TestPrometheusDeleteSeriesOnNaN(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithDeleteSeriesOnNaN(true)
+	ratio := metrics.NewGaugeFloat64()
+	metricsRegistry.Register("ratio", ratio)
+	metricsRegistry.Register("other", metrics.NewGauge())
+
+	for _, value := range []float64{0.5, 0.5, math.NaN(), math.NaN(), 0.25, 0.75} {
+		ratio.Update(value)
+		pClient.UpdatePrometheusMetricsOnce()
+		metrics, err := prometheusRegistry.Gather()
+		if err != nil {
+			t.Fatalf("gather failed: %v", err)
+		}
+		exported, ok := math.NaN(), false
+		for _, metric := range metrics {
+			if metric.GetName() == "test_subsys_ratio" && len(metric.GetMetric()) > 0 {
+				exported, ok = metric.GetMetric()[0].GetGauge().GetValue(), true
+			}
+		}
+		if math.IsNaN(value) && ok {
+			t.Fatalf("expected the NaN series to be removed, got %v", exported)
+		}
+		if !math.IsNaN(value) && exported != value {
+			t.Fatalf("Expected: %v, actual: %v", value, exported)
+		}
+	}
+}
+
+func TestPrometheusHistogramCountSumOnly(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithHistogramMode(ModeCountSumOnly).
+		WithNativeCounters(true)
+	histogram := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	metricsRegistry.Register("payload", histogram)
+	histogram.Update(10)
+	histogram.Update(32)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	exported := map[string]string{}
+	for _, metric := range metrics {
+		series := metric.GetMetric()[0]
+		value := series.GetGauge().GetValue() + series.GetCounter().GetValue()
+		exported[metric.GetName()] = fmt.Sprintf("%s %v", metric.GetType(), value)
+	}
+	expected := map[string]string{
+		"test_subsys_payload_count": "COUNTER 2",
+		"test_subsys_payload_sum":   "GAUGE 42",
+	}
+	if !reflect.DeepEqual(exported, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, exported)
+	}
+}
+
+func TestPrometheusHistogramUnit(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithHistogramMode(ModeSampleBuckets).
+		WithHistogramUnit(time.Second).
+		WithHistogramBuckets([]float64{0.001, 0.005, 0.01, 0.1})
+	histogram := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	metricsRegistry.Register("request", histogram)
+	for _, d := range []time.Duration{1 * time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond, 50 * time.Millisecond} {
+		histogram.Update(int64(d))
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	if lastSample := metrics[0].GetMetric()[0].GetGauge().GetValue(); lastSample != 0.05 {
+		t.Fatalf("Expected: last sample 0.05, actual: %v", lastSample)
+	}
+	exported := metrics[1].GetMetric()[0].GetHistogram()
+	if exported.GetSampleSum() != 0.058 {
+		t.Fatalf("Expected: sum 0.058, actual: sum %v", exported.GetSampleSum())
+	}
+	buckets := map[float64]uint64{}
+	for _, bucket := range exported.GetBucket() {
+		buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+	}
+	expected := map[float64]uint64{0.001: 1, 0.005: 3, 0.01: 3, 0.1: 4}
+	if !reflect.DeepEqual(buckets, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, buckets)
+	}
+}
+
+func TestPrometheusDropZeroCounters(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithDropZeroCounters(true)
+	counter := metrics.NewCounter()
+	metricsRegistry.Register("errors", counter)
+	metricsRegistry.Register("requests", metrics.NewCounter())
+	pClient.UpdatePrometheusMetricsOnce()
+	if metrics, _ := prometheusRegistry.Gather(); len(metrics) != 0 {
+		t.Fatalf("Expected zero counters to be dropped, got %v", metrics)
+	}
+
+	counter.Inc(2)
+	pClient.UpdatePrometheusMetricsOnce()
+	counter.Clear()
+	pClient.UpdatePrometheusMetricsOnce()
+	if exported, ok := pClient.LastValue("errors"); !ok || exported != 0 {
+		t.Fatalf("Expected the cleared counter to be exported as 0, got %v", exported)
+	}
+	if skipped := pClient.SkippedMetrics(); !reflect.DeepEqual(skipped, map[string]string{"requests": "zero counter"}) {
+		t.Fatalf("Expected requests to be skipped, got %v", skipped)
+	}
+}
+
+func TestPrometheusObservationCountCounter(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithObservationCountCounter(true).
+		WithTimerMode(ModeCompactSummary)
+	histogram := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	timer := metrics.NewTimer()
+	metricsRegistry.Register("payload", histogram)
+	metricsRegistry.Register("latency", timer)
+	histogram.Update(10)
+	timer.Update(time.Millisecond)
+	pClient.UpdatePrometheusMetricsOnce()
+	histogram.Update(20)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	counters := make(map[string]float64)
+	for _, metric := range metrics {
+		if strings.HasSuffix(metric.GetName(), "_count_total") {
+			counters[metric.GetName()] = metric.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	expected := map[string]float64{"test_subsys_payload_count_total": 2, "test_subsys_latency_count_total": 1}
+	if !reflect.DeepEqual(counters, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, counters)
+	}
+}
+
+func TestPrometheusTimerSumAsCounter(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTimerSumAsCounter(true).
+		WithTimerMode(ModeCounterOnly).
+		WithTimerUnit(time.Millisecond)
+	timer := metrics.NewTimer()
+	metricsRegistry.Register("latency", timer)
+	timer.Update(3 * time.Millisecond)
+	pClient.UpdatePrometheusMetricsOnce()
+	timer.Update(4 * time.Millisecond)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	counters := make(map[string]float64)
+	for _, metric := range metrics {
+		counters[metric.GetName()] = metric.GetMetric()[0].GetCounter().GetValue()
+	}
+	expected := map[string]float64{"test_subsys_latency_count": 2, "test_subsys_latency_sum_total": 7}
+	if !reflect.DeepEqual(counters, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, counters)
+	}
+}
+
+func TestPrometheusLabelProcessor(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLabelExtractor(func(name string) (string, prometheus.Labels) {
+			parts := strings.SplitN(name, "-for-partition-", 2)
+			return parts[0], prometheus.Labels{"for_partition": parts[1]}
+		}).
+		WithLabelKeyRename(map[string]string{"for_partition": "partition"}).
+		WithLabelProcessor(func(name string, labels prometheus.Labels) prometheus.Labels {
+			partition, _ := strconv.Atoi(labels["partition"])
+			return prometheus.Labels{"partitions": fmt.Sprintf("%d-%d", partition/10*10, partition/10*10+9)}
+		})
+	metricsRegistry.Register("lag-for-partition-13", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	label := metrics[0].GetMetric()[0].GetLabel()[0]
+	if label.GetName() != "partitions" || label.GetValue() != "10-19" {
+		t.Fatalf("Expected: %v, actual: %v", `partitions="10-19"`, label)
+	}
+}
+
+func TestPrometheusTimerCompactSummaryExposition(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		WithTimerMode(ModeCompactSummary).
+		WithTimerUnit(time.Second).
+		WithTimerBuckets([]float64{0.5, 0.99})
+	timer := metrics.NewTimer()
+	metricsRegistry.Register("request", timer)
+	timer.Update(1 * time.Second)
+	timer.Update(3 * time.Second)
+	text, err := pClient.TextExposition()
+	if err != nil {
+		t.Fatalf("TextExposition failed: %v", err)
+	}
+
+	for _, line := range []string{
+		"# TYPE test_subsys_request summary",
+		`test_subsys_request{quantile="0.5"} 2`,
+		`test_subsys_request{quantile="0.99"} 3`,
+		"test_subsys_request_sum 4",
+		"test_subsys_request_count 2",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatalf("Expected %q in:\n%s", line, text)
+		}
+	}
+}
+
+func TestPrometheusPause(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("in.flight", gauge)
+	gauge.Update(1)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	pClient.Pause()
+	if !pClient.Paused() {
+		t.Fatalf("Expected the provider to be paused")
+	}
+	gauge.Update(2)
+	pClient.UpdatePrometheusMetricsOnce()
+	if exported, _ := pClient.LastValue("in.flight"); exported != 1 {
+		t.Fatalf("Expected the value of the last flush, 1, while paused, got %v", exported)
+	}
+
+	pClient.Resume()
+	pClient.UpdatePrometheusMetricsOnce()
+	if exported, _ := pClient.LastValue("in.flight"); exported != 2 {
+		t.Fatalf("Expected: %v, actual: %v", 2, exported)
+	}
+}
+
+func TestPrometheusNameValidator(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var errs []string
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithNameValidator(regexp.MustCompile(`^test_subsys_[a-z]+_(bytes|seconds|total)(_histogram)?$`)).
+		WithHistogramMode(ModeSampleBuckets).
+		WithErrorHandler(func(err error) {
+			errs = append(errs, err.Error())
+		})
+	metricsRegistry.Register("payload_bytes", metrics.NewHistogram(metrics.NewUniformSample(10)))
+	metricsRegistry.Register("requests_total", metrics.NewCounter())
+	metricsRegistry.Register("inflight", metrics.NewGauge())
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	var names []string
+	for _, metric := range metrics {
+		names = append(names, metric.GetName())
+	}
+	if expected := []string{"test_subsys_payload_bytes_histogram", "test_subsys_requests_total"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, names)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0], "test_subsys_inflight") {
+		t.Fatalf("Expected the gauge to be reported, got %v", errs)
+	}
+}
+
+func TestPrometheusGaugeLabelSchemaChange(t *testing.T) {
+	for _, mode := range []ExportMode{Stateful, ConstMetric} {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+			WithExportMode(mode).
+			WithLabelExtractor(func(name string) (string, prometheus.Labels) {
+				parts := strings.SplitN(name, "-for-topic-", 2)
+				if len(parts) == 1 {
+					return name, nil
+				}
+				return parts[0], prometheus.Labels{"for_topic": parts[1]}
+			})
+		metricsRegistry.Register("records", metrics.NewGauge())
+		if err := pClient.UpdatePrometheusMetricsOnce(); err != nil {
+			t.Fatalf("mode %v: flush failed: %v", mode, err)
+		}
+		metricsRegistry.Unregister("records")
+		metricsRegistry.Register("records-for-topic-a", metrics.NewGauge())
+		err := pClient.UpdatePrometheusMetricsOnce()
+		metrics, gatherErr := prometheusRegistry.Gather()
+		if gatherErr != nil {
+			t.Fatalf("mode %v: gather failed: %v", mode, gatherErr)
+		}
+
+		switch mode {
+		case Stateful:
+			// the Prometheus registry keeps the label names of a name even
+			// once its collector is unregistered
+			if err == nil || !strings.Contains(err.Error(), "don't match its existing series") {
+				t.Fatalf("mode %v: expected the changed label names to be reported, got %v", mode, err)
+			}
+		case ConstMetric:
+			if err != nil || len(metrics) != 1 || metrics[0].GetMetric()[0].GetLabel()[0].GetValue() != "a" {
+				t.Fatalf("mode %v: expected only the labelled series, got %v and %v", mode, err, metrics)
+			}
+		}
+	}
+}
+
+func TestPrometheusEmptyTimerHasNoNaN(t *testing.T) {
+	for _, mode := range []TimerMode{ModeVerbose, ModeCounterAndGauges, ModeCompactSummary, ModeDurationHistogram, ModeCounterOnly} {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+			WithTimerMode(mode).
+			WithTimerBuckets([]float64{0.5, 0.99})
+		metricsRegistry.Register("timer", NewSampledTimer(metrics.NewExpDecaySample(1028, 0.015)))
+		if err := pClient.UpdatePrometheusMetricsOnce(); err != nil {
+			t.Fatalf("flush in mode %v failed: %v", mode, err)
+		}
+		metrics, err := prometheusRegistry.Gather()
+		if err != nil {
+			t.Fatalf("gather failed: %v", err)
+		}
+
+		for _, metric := range metrics {
+			series := metric.GetMetric()[0]
+			values := []float64{series.GetGauge().GetValue(), series.GetCounter().GetValue(), series.GetSummary().GetSampleSum(), series.GetHistogram().GetSampleSum()}
+			for _, quantile := range series.GetSummary().GetQuantile() {
+				values = append(values, quantile.GetValue())
+			}
+			for _, value := range values {
+				if math.IsNaN(value) {
+					t.Fatalf("%s of the empty timer is NaN in mode %v: %v", metric.GetName(), mode, series)
+				}
+			}
+		}
+	}
+}
+
+func TestPrometheusTimerCounterOnly(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTimerMode(ModeCounterOnly)
+	timer := metrics.NewTimer()
+	metricsRegistry.Register("timer", timer)
+	timer.Update(2 * time.Second)
+	timer.Update(4 * time.Second)
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	if len(metrics) != 1 || metrics[0].GetName() != "test_subsys_timer_count" || metrics[0].GetType().String() != "COUNTER" {
+		t.Fatalf("expected only the count counter, got %v", metrics)
+	}
+	if count := metrics[0].GetMetric()[0].GetCounter().GetValue(); count != 2 {
+		t.Fatalf("Expected: %v, actual: %v", 2, count)
+	}
+}
@@ -0,0 +1,67 @@
+package prometheusmetrics
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxRegistrationWait is the most flushes WithRegistrationBackoff waits
+// between attempts to register a collector.
+const maxRegistrationWait = 32
+
+// pendingRegistration is a collector the Prometheus registry failed to
+// register.
+type pendingRegistration struct {
+	attempts int
+	retryAt  uint64 // number of the flush making the next attempt
+}
+
+// WithRegistrationBackoff makes flushes retry registering the collectors the
+// Prometheus registry failed to register, e.g. while other collectors are
+// being registered concurrently. Their metrics aren't exported until they're
+// registered. After each failure, twice as many flushes are waited before the
+// next attempt, up to 32. From the maxAttempts-th failed attempt on, the
+// registration error is reported to the error handler.
+func (c *PrometheusConfig) WithRegistrationBackoff(maxAttempts int) *PrometheusConfig {
+	c.registrationAttempts = maxAttempts
+	return c
+}
+
+// registerKey registers the collector of key, see register. Unless
+// registration errors are retried, see WithRegistrationBackoff, a nil
+// collector is returned along with the error, e.g. for an invalid name, and
+// the next flush tries again. Otherwise a nil collector is returned while its
+// registration is pending, along with the error once attempts are exhausted.
+func (c *PrometheusConfig) registerKey(key string, collector prometheus.Collector) (prometheus.Collector, error) {
+	if c.registrationAttempts <= 0 {
+		registered, err := c.register(collector)
+		if err != nil {
+			return nil, fmt.Errorf("not exporting %s: registering it failed: %v", key, err)
+		}
+		return registered, nil
+	}
+	pending, isPending := c.pendingRegistrations[key]
+	if isPending && c.flushNumber < pending.retryAt {
+		return nil, nil
+	}
+	registered, err := c.register(collector)
+	if err == nil {
+		delete(c.pendingRegistrations, key)
+		return registered, nil
+	}
+	if !isPending {
+		pending = &pendingRegistration{}
+		c.pendingRegistrations[key] = pending
+	}
+	pending.attempts++
+	wait := uint64(1) << uint(pending.attempts-1)
+	if wait > maxRegistrationWait {
+		wait = maxRegistrationWait
+	}
+	pending.retryAt = c.flushNumber + wait
+	if pending.attempts >= c.registrationAttempts {
+		return nil, fmt.Errorf("not exporting %s: registering it failed %d times: %v", key, pending.attempts, err)
+	}
+	return nil, nil
+}
@@ -0,0 +1,168 @@
+package prometheusmetrics
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+// defaultSelfMetricsPrefix is the prefix of the self-metrics' names unless
+// set with WithSelfMetricsPrefix.
+const defaultSelfMetricsPrefix = "go_metrics_prometheus"
+
+// selfMetrics are the metrics the provider exports about itself.
+type selfMetrics struct {
+	flushes        prometheus.Counter
+	flushDurations *prometheus.GaugeVec
+	skippedTicks   prometheus.CounterFunc
+	droppedSeries  prometheus.CounterFunc
+	info           prometheus.Gauge
+}
+
+// WithSelfMetrics exports metrics about the provider itself alongside the
+// go-metrics, e.g. go_metrics_prometheus_flushes_total, the number of
+// successful flushes, whose rate shows whether the exporter keeps up with its
+// flush interval, go_metrics_prometheus_flush_duration_seconds, the time the
+// last flush spent exporting each type of go-metric,
+// go_metrics_prometheus_flush_skipped_total, the number of ticks
+// UpdatePrometheusMetrics skipped as a flush was still running,
+// go_metrics_prometheus_series_dropped_total, the number of series dropped by
+// the cardinality caps, see WithMaxSeries, and go_metrics_prometheus_info,
+// whose namespace, subsystem and flush_interval labels show how the provider
+// names and flushes go-metrics.
+func (c *PrometheusConfig) WithSelfMetrics(enabled bool) *PrometheusConfig {
+	c.selfMetricsEnabled = enabled
+	return c
+}
+
+// WithSelfMetricsPrefix replaces the go_metrics_prometheus prefix of the
+// self-metrics' names, so the self-metrics of several providers sharing a
+// Prometheus registry don't collide.
+func (c *PrometheusConfig) WithSelfMetricsPrefix(prefix string) *PrometheusConfig {
+	c.selfMetricsPrefix = prefix
+	return c
+}
+
+// selfMetricName returns the prefixed name of a self-metric.
+func (c *PrometheusConfig) selfMetricName(name string) string {
+	if c.selfMetricsPrefix == "" {
+		return defaultSelfMetricsPrefix + "_" + name
+	}
+	return c.selfMetricsPrefix + "_" + name
+}
+
+// selfMetrics returns the provider's self-metrics, registering them on first
+// use, or nil if they're disabled. It must be called with flushMutex held.
+func (c *PrometheusConfig) selfMetrics() *selfMetrics {
+	if !c.selfMetricsEnabled {
+		return nil
+	}
+	if c.self == nil {
+		flushes := prometheus.NewCounter(prometheus.CounterOpts{
+			Name: c.selfMetricName("flushes_total"),
+			Help: "Number of successful flushes of go-metrics to Prometheus.",
+		})
+		registered := c.registerSelfMetric(flushes)
+		if existing, ok := registered.(prometheus.Counter); ok {
+			flushes = existing
+		}
+		flushDurations := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: c.selfMetricName("flush_duration_seconds"),
+			Help: "Time the last flush spent exporting go-metrics, by their type.",
+		}, []string{"metric_type"})
+		registered = c.registerSelfMetric(flushDurations)
+		if existing, ok := registered.(*prometheus.GaugeVec); ok {
+			flushDurations = existing
+		}
+		skippedTicks := prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: c.selfMetricName("flush_skipped_total"),
+			Help: "Number of ticks of the flush loop skipped as a flush was still running.",
+		}, func() float64 {
+			return float64(atomic.LoadUint64(&c.skippedTicks))
+		})
+		registered = c.registerSelfMetric(skippedTicks)
+		if existing, ok := registered.(prometheus.CounterFunc); ok {
+			skippedTicks = existing
+		}
+		droppedSeries := prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: c.selfMetricName("series_dropped_total"),
+			Help: "Number of series dropped by the cardinality caps.",
+		}, func() float64 {
+			return float64(atomic.LoadUint64(&c.droppedSeriesTotal))
+		})
+		registered = c.registerSelfMetric(droppedSeries)
+		if existing, ok := registered.(prometheus.CounterFunc); ok {
+			droppedSeries = existing
+		}
+		info := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: c.selfMetricName("info"),
+			Help: "Configuration of the go-metrics exporter, the value is always 1.",
+			ConstLabels: prometheus.Labels{
+				"namespace":      c.namespace,
+				"subsystem":      c.subsystem,
+				"flush_interval": c.FlushInterval.String(),
+			},
+		})
+		info.Set(1)
+		registered = c.registerSelfMetric(info)
+		if existing, ok := registered.(prometheus.Gauge); ok {
+			info = existing
+		}
+		c.self = &selfMetrics{flushes: flushes, flushDurations: flushDurations, skippedTicks: skippedTicks, droppedSeries: droppedSeries, info: info}
+	}
+	return c.self
+}
+
+// registerSelfMetric registers a self-metric, see register. Registration
+// errors, e.g. of a prefix making an invalid name, are passed to the error
+// handler, as the self-metric is missing otherwise.
+func (c *PrometheusConfig) registerSelfMetric(collector prometheus.Collector) prometheus.Collector {
+	registered, err := c.register(collector)
+	if err != nil {
+		c.handleError(fmt.Errorf("not exporting self-metrics: registering them failed: %v", err))
+	}
+	return registered
+}
+
+// unregisterSelfMetrics unregisters the provider's self-metrics, reporting
+// whether the Prometheus registry held them.
+func (c *PrometheusConfig) unregisterSelfMetrics() bool {
+	if c.self == nil {
+		return true
+	}
+	registered := c.unregister(c.self.flushes)
+	registered = c.unregister(c.self.flushDurations) && registered
+	registered = c.unregister(c.self.skippedTicks) && registered
+	registered = c.unregister(c.self.droppedSeries) && registered
+	registered = c.unregister(c.self.info) && registered
+	c.self = nil
+	return registered
+}
+
+// recordFlushDuration adds the time since start to the flush durations of the
+// type of the go-metric i.
+func recordFlushDuration(durations map[string]time.Duration, i interface{}, start time.Time) {
+	durations[metricType(i)] += time.Since(start)
+}
+
+// metricType returns the name of the type of the go-metric i.
+func metricType(i interface{}) string {
+	switch i.(type) {
+	case metrics.Counter:
+		return "counter"
+	case metrics.Gauge:
+		return "gauge"
+	case metrics.GaugeFloat64:
+		return "gauge_float64"
+	case metrics.Histogram:
+		return "histogram"
+	case metrics.Meter:
+		return "meter"
+	case metrics.Timer:
+		return "timer"
+	}
+	return "other"
+}
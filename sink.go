@@ -0,0 +1,71 @@
+package prometheusmetrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sink receives the series go-metrics are mapped to by a flush, so they can be
+// exported somewhere other than a Prometheus registry, e.g. to the instruments
+// of an OpenTelemetry meter. Names are fully qualified Prometheus names and
+// labels include the provider's const labels. StatsDSink implements it for
+// StatsD.
+type Sink interface {
+	// Gauge receives the current value of a gauge series.
+	Gauge(name string, value float64, labels prometheus.Labels) error
+	// Counter receives the cumulative value of a counter series.
+	Counter(name string, value float64, labels prometheus.Labels) error
+	// Metric receives a series exported as a Prometheus histogram or summary,
+	// whose buckets or quantiles its Write method reads out.
+	Metric(name string, labels prometheus.Labels, metric prometheus.Metric) error
+}
+
+// FlushTo exports every go-metric in the registry to sink once, mapping them
+// like flushes to the Prometheus registry do.
+func (c *PrometheusConfig) FlushTo(sink Sink) error {
+	c.flushMutex.Lock()
+	defer c.flushMutex.Unlock()
+	return c.flush(sinkWriter{c, sink})
+}
+
+// sinkWriter writes to a Sink.
+type sinkWriter struct {
+	*PrometheusConfig
+	sink Sink
+}
+
+func (w sinkWriter) gauge(name string, val float64, labels prometheus.Labels) error {
+	if w.deletesSeries(val) {
+		return nil
+	}
+	return w.sink.Gauge(w.fqName(name), w.rounded(val), w.sinkLabels(labels))
+}
+
+func (w sinkWriter) counter(name string, val float64, labels prometheus.Labels) error {
+	return w.sink.Counter(w.fqName(name), val, w.sinkLabels(labels))
+}
+
+func (w sinkWriter) removeGauge(name string) {
+	// sinks keep no series
+}
+
+func (w sinkWriter) removeCounter(name string) {
+	// sinks keep no series
+}
+
+func (w sinkWriter) constMetric(name string, labels prometheus.Labels, metric prometheus.Metric) error {
+	return w.sink.Metric(descName(metric.Desc()), w.sinkLabels(labels), metric)
+}
+
+// sinkLabels returns labels along with the const labels.
+func (w sinkWriter) sinkLabels(labels prometheus.Labels) prometheus.Labels {
+	sinkLabels := w.constLabelsWithout(labels)
+	for name, value := range labels {
+		sinkLabels[name] = value
+	}
+	return sinkLabels
+}
+
+// fqName returns the fully qualified Prometheus name of the series name.
+func (c *PrometheusConfig) fqName(name string) string {
+	return prometheus.BuildFQName(c.flattenKey(c.namespace), c.flattenKey(c.subsystem), c.flattenKey(name))
+}
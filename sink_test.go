@@ -0,0 +1,51 @@
+package prometheusmetrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+// recordingSink records the names and kinds of the series it receives.
+type recordingSink map[string]string
+
+func (s recordingSink) Gauge(name string, value float64, labels prometheus.Labels) error {
+	s[name] = "gauge"
+	return nil
+}
+
+func (s recordingSink) Counter(name string, value float64, labels prometheus.Labels) error {
+	s[name] = "counter"
+	return nil
+}
+
+func (s recordingSink) Metric(name string, labels prometheus.Labels, metric prometheus.Metric) error {
+	s[name] = "metric"
+	return nil
+}
+
+func TestFlushTo(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		WithNativeCounters(true).
+		WithTimerMode(ModeDurationHistogram)
+	metricsRegistry.Register("requests", metrics.NewCounter())
+	metricsRegistry.Register("in.flight", metrics.NewGauge())
+	metricsRegistry.Register("latency", NewSampledTimer(metrics.NewUniformSample(10)))
+	sink := make(recordingSink)
+	if err := pClient.FlushTo(sink); err != nil {
+		t.Fatalf("FlushTo failed: %v", err)
+	}
+
+	expected := recordingSink{
+		"test_subsys_requests":      "counter",
+		"test_subsys_in_flight":     "gauge",
+		"test_subsys_latency_timer": "metric",
+	}
+	if !reflect.DeepEqual(sink, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, sink)
+	}
+}
@@ -0,0 +1,192 @@
+package prometheusmetrics
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxStatsDPacket is the most bytes StatsDSink writes at once, so packets fit
+// into the MTU of common networks.
+const maxStatsDPacket = 1432
+
+// statsDTagReplacer replaces the characters that delimit StatsD lines and
+// DogStatsD tags in tag values.
+var statsDTagReplacer = strings.NewReplacer(",", "_", "|", "_", ":", "_", "\n", "_")
+
+// StatsDSink is a Sink formatting series as StatsD lines, so go-metrics can be
+// bridged to StatsD collectors with the same mapping as to Prometheus. Gauges
+// become StatsD gauges, counters StatsD counters of their increase since the
+// previous flush, and histograms and summaries gauges of their count, sum and
+// quantiles. Labels are appended as DogStatsD tags, e.g. |#region:eu, which
+// plain StatsD servers don't understand, so leave labels out for those. The
+// characters ',', '|', ':' and newlines in label values are replaced with '_'.
+// NaN and infinite values aren't sent, and as StatsD reads signed gauge values
+// as changes, a negative gauge is sent as a 0 followed by its value.
+//
+// Lines are buffered and written in packets of at most 1432 bytes, so flush
+// with FlushTo and then call Flush, e.g.:
+//
+//	conn, err := net.Dial("udp", "localhost:8125")
+//	...
+//	sink := NewStatsDSink(conn)
+//	if err := pClient.FlushTo(sink); err != nil {
+//		...
+//	}
+//	err = sink.Flush()
+type StatsDSink struct {
+	w        io.Writer
+	mutex    sync.Mutex
+	buf      bytes.Buffer
+	counters map[string]float64 // value of the previous flush, by series
+}
+
+// NewStatsDSink returns a StatsDSink writing packets to w, e.g. a UDP
+// connection.
+func NewStatsDSink(w io.Writer) *StatsDSink {
+	return &StatsDSink{
+		w:        w,
+		counters: make(map[string]float64),
+	}
+}
+
+// Gauge buffers the line of a gauge, preceded by a line setting it to 0 if
+// it's negative.
+func (s *StatsDSink) Gauge(name string, value float64, labels prometheus.Labels) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if value < 0 && !math.IsInf(value, -1) {
+		return s.write(statsDLine(name, 0, "g", labels), statsDLine(name, value, "g", labels))
+	}
+	return s.line(name, value, "g", labels)
+}
+
+// Counter buffers the line of the increase of a counter since the previous
+// flush. The first flush sends the whole value, as does the flush after the
+// counter was reset.
+func (s *StatsDSink) Counter(name string, value float64, labels prometheus.Labels) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	key := name + labelSignature(labels)
+	increase := value
+	if previous, ok := s.counters[key]; ok && value >= previous {
+		increase = value - previous
+	}
+	s.counters[key] = value
+	if increase == 0 {
+		return nil
+	}
+	return s.line(name, increase, "c", labels)
+}
+
+// Metric buffers the lines of the count, sum and quantiles of a histogram or
+// summary as gauges. Buckets aren't sent.
+func (s *StatsDSink) Metric(name string, labels prometheus.Labels, metric prometheus.Metric) error {
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var count uint64
+	var sum float64
+	switch {
+	case m.Histogram != nil:
+		count, sum = m.Histogram.GetSampleCount(), m.Histogram.GetSampleSum()
+	case m.Summary != nil:
+		count, sum = m.Summary.GetSampleCount(), m.Summary.GetSampleSum()
+		for _, quantile := range m.Summary.GetQuantile() {
+			quantileLabels := prometheus.Labels{"quantile": strconv.FormatFloat(quantile.GetQuantile(), 'g', -1, 64)}
+			for labelName, labelValue := range labels {
+				quantileLabels[labelName] = labelValue
+			}
+			if err := s.line(name, quantile.GetValue(), "g", quantileLabels); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+	if err := s.line(name+"_count", float64(count), "g", labels); err != nil {
+		return err
+	}
+	return s.line(name+"_sum", sum, "g", labels)
+}
+
+// Flush writes the buffered lines.
+func (s *StatsDSink) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.flush()
+}
+
+// line buffers a StatsD line, unless value is NaN or infinite. It must be
+// called with mutex held.
+func (s *StatsDSink) line(name string, value float64, statsDType string, labels prometheus.Labels) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	return s.write(statsDLine(name, value, statsDType, labels))
+}
+
+// write buffers lines, writing the buffered lines first if they'd exceed a
+// packet, so lines buffered together are sent in the same packet. It must be
+// called with mutex held.
+func (s *StatsDSink) write(lines ...[]byte) error {
+	size := 0
+	for _, line := range lines {
+		size += 1 + len(line)
+	}
+	if s.buf.Len() > 0 && s.buf.Len()+size > maxStatsDPacket {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+	for _, line := range lines {
+		if s.buf.Len() > 0 {
+			s.buf.WriteByte('\n')
+		}
+		s.buf.Write(line)
+	}
+	return nil
+}
+
+// statsDLine formats a StatsD line with labels as DogStatsD tags.
+func statsDLine(name string, value float64, statsDType string, labels prometheus.Labels) []byte {
+	var line bytes.Buffer
+	line.WriteString(name)
+	line.WriteByte(':')
+	line.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	line.WriteByte('|')
+	line.WriteString(statsDType)
+	for i, labelName := range labelNames(labels) {
+		if i == 0 {
+			line.WriteString("|#")
+		} else {
+			line.WriteByte(',')
+		}
+		line.WriteString(labelName)
+		line.WriteByte(':')
+		line.WriteString(statsDTagReplacer.Replace(labels[labelName]))
+	}
+	return line.Bytes()
+}
+
+// flush writes the buffered lines. It must be called with mutex held.
+func (s *StatsDSink) flush() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	_, err := s.w.Write(s.buf.Bytes())
+	s.buf.Reset()
+	return err
+}
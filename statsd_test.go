@@ -0,0 +1,151 @@
+package prometheusmetrics
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+// packetRecorder records every write as a packet.
+type packetRecorder struct {
+	packets []string
+}
+
+func (r *packetRecorder) Write(p []byte) (int, error) {
+	r.packets = append(r.packets, string(p))
+	return len(p), nil
+}
+
+func TestStatsDSink(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		WithNativeCounters(true).
+		WithTimerMode(ModeCompactSummary).
+		WithTimerBuckets([]float64{0.5}).
+		WithLabelExtractor(func(name string) (string, prometheus.Labels) {
+			if parts := strings.SplitN(name, ".", 2); len(parts) == 2 {
+				return parts[0], prometheus.Labels{"region": parts[1]}
+			}
+			return name, nil
+		})
+	requests := metrics.NewCounter()
+	timer := metrics.NewTimer()
+	metricsRegistry.Register("requests", requests)
+	metricsRegistry.Register("in_flight.eu", metrics.NewGauge())
+	metricsRegistry.Register("latency", timer)
+	requests.Inc(5)
+	timer.Update(2)
+	recorder := &packetRecorder{}
+	sink := NewStatsDSink(recorder)
+	for i := 0; i < 2; i++ {
+		if err := pClient.FlushTo(sink); err != nil {
+			t.Fatalf("FlushTo failed: %v", err)
+		}
+		requests.Inc(2)
+		if err := sink.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+
+	var lines [][]string
+	for _, packet := range recorder.packets {
+		packetLines := strings.Split(packet, "\n")
+		sort.Strings(packetLines)
+		lines = append(lines, packetLines)
+	}
+	expected := [][]string{
+		{
+			"test_subsys_in_flight:0|g|#region:eu",
+			"test_subsys_latency:2|g|#quantile:0.5",
+			"test_subsys_latency_count:1|g",
+			"test_subsys_latency_sum:2|g",
+			"test_subsys_requests:5|c",
+		},
+		{
+			"test_subsys_in_flight:0|g|#region:eu",
+			"test_subsys_latency:2|g|#quantile:0.5",
+			"test_subsys_latency_count:1|g",
+			"test_subsys_latency_sum:2|g",
+			"test_subsys_requests:2|c",
+		},
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("Expected: %q, actual: %q", expected, lines)
+	}
+}
+
+func TestStatsDSinkPacketSize(t *testing.T) {
+	recorder := &packetRecorder{}
+	sink := NewStatsDSink(recorder)
+	for i := 0; i < 100; i++ {
+		sink.Gauge("test_subsys_gauge_with_a_rather_long_name", float64(i), nil)
+	}
+	sink.Flush()
+
+	if len(recorder.packets) < 2 {
+		t.Fatalf("expected the lines to be split into several packets, got %d", len(recorder.packets))
+	}
+	lines := 0
+	for _, packet := range recorder.packets {
+		if len(packet) > maxStatsDPacket {
+			t.Fatalf("packet of %d bytes exceeds %d", len(packet), maxStatsDPacket)
+		}
+		lines += len(strings.Split(packet, "\n"))
+	}
+	if lines != 100 {
+		t.Fatalf("Expected: 100 lines, actual: %d", lines)
+	}
+}
+
+func TestStatsDSinkValues(t *testing.T) {
+	recorder := &packetRecorder{}
+	sink := NewStatsDSink(recorder)
+	sink.Gauge("temperature", -5, nil)
+	sink.Gauge("ratio", math.NaN(), nil)
+	sink.Gauge("ratio", math.Inf(-1), nil)
+	sink.Counter("requests", math.Inf(1), nil)
+	sink.Gauge("in_flight", 1, prometheus.Labels{"path": "/a,b|c:d"})
+	sink.Flush()
+
+	expected := []string{
+		"temperature:0|g\ntemperature:-5|g\nin_flight:1|g|#path:/a_b_c_d",
+	}
+	if !reflect.DeepEqual(recorder.packets, expected) {
+		t.Fatalf("Expected: %q, actual: %q", expected, recorder.packets)
+	}
+}
+
+func TestStatsDSinkVerboseTimer(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+	timer := metrics.NewTimer()
+	metricsRegistry.Register("latency", timer)
+	timer.Update(2)
+	recorder := &packetRecorder{}
+	sink := NewStatsDSink(recorder)
+	if err := pClient.FlushTo(sink); err != nil {
+		t.Fatalf("FlushTo failed: %v", err)
+	}
+	sink.Flush()
+
+	names := map[string]int{}
+	for _, packet := range recorder.packets {
+		for _, line := range strings.Split(packet, "\n") {
+			names[line[:strings.Index(line, ":")]]++
+		}
+	}
+	for name, lines := range names {
+		if lines > 1 && !strings.HasPrefix(name, "test_subsys_latency_timer") {
+			t.Fatalf("%s sent %d times", name, lines)
+		}
+	}
+	if names["test_subsys_latency_timer_count"] != 1 || names["test_subsys_latency_count"] != 1 {
+		t.Fatalf("expected the timer's count and its histogram's count once each, got %v", names)
+	}
+}
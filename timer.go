@@ -0,0 +1,81 @@
+package prometheusmetrics
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+// SampledTimer is a go-metrics Timer whose sample of durations can be
+// exported, as required by ModeDurationHistogram. Register it with the
+// go-metrics registry like any other timer.
+type SampledTimer struct {
+	metrics.Timer
+	histogram metrics.Histogram
+}
+
+// NewSampledTimer returns a SampledTimer keeping its durations in sample,
+// e.g. metrics.NewExpDecaySample(1028, 0.015).
+func NewSampledTimer(sample metrics.Sample) *SampledTimer {
+	histogram := metrics.NewHistogram(sample)
+	return &SampledTimer{
+		Timer:     metrics.NewCustomTimer(histogram, metrics.NewMeter()),
+		histogram: histogram,
+	}
+}
+
+// Sample returns the timer's sample of durations in nanoseconds.
+func (t *SampledTimer) Sample() metrics.Sample {
+	return t.histogram.Sample()
+}
+
+// Snapshot returns a read-only copy of the timer, including its sample.
+func (t *SampledTimer) Snapshot() metrics.Timer {
+	return &sampledTimerSnapshot{
+		Timer:  t.Timer.Snapshot(),
+		sample: t.histogram.Sample().Snapshot(),
+	}
+}
+
+type sampledTimerSnapshot struct {
+	metrics.Timer
+	sample metrics.Sample
+}
+
+func (s *sampledTimerSnapshot) Sample() metrics.Sample {
+	return s.sample
+}
+
+func (s *sampledTimerSnapshot) Snapshot() metrics.Timer {
+	return s
+}
+
+// durationHistogramFromNameAndSnapshot tallies the durations in the sample of
+// a timer snapshot into the timer buckets. Count and sum are those of the
+// sample, so the buckets add up to the count however many durations the
+// sample has evicted.
+func (c *PrometheusConfig) durationHistogramFromNameAndSnapshot(name string, snapshot metrics.Timer, labels prometheus.Labels) (prometheus.Metric, error) {
+	sampled, ok := snapshot.(interface{ Sample() metrics.Sample })
+	if !ok {
+		return nil, fmt.Errorf("not exporting timer %s as a duration histogram: %T doesn't expose its sample, use a SampledTimer", name, snapshot)
+	}
+	if len(c.timerBuckets) == 0 {
+		return nil, fmt.Errorf("not exporting histogram %s: no buckets configured", name)
+	}
+
+	durations := sampled.Sample().Values()
+	var sum float64
+	for _, duration := range durations {
+		sum += float64(duration)
+	}
+
+	desc, values := c.histogramDesc(name, "timer", labels)
+	return prometheus.NewConstHistogram(
+		desc,
+		uint64(len(durations)),
+		c.inTimerUnit(sum),
+		tally(durations, c.timerBuckets, c.inTimerUnit),
+		values...,
+	)
+}
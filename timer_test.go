@@ -0,0 +1,83 @@
+package prometheusmetrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestDurationHistogram(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTimerMode(ModeDurationHistogram).
+		WithTimerUnit(time.Second).
+		WithTimerBuckets([]float64{0.001, 0.005, 0.01, 0.1})
+	timer := NewSampledTimer(metrics.NewUniformSample(1028))
+	metricsRegistry.Register("request", timer)
+	for _, d := range []time.Duration{1 * time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond, 50 * time.Millisecond} {
+		timer.Update(d)
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	if len(metrics) != 1 || metrics[0].GetName() != "test_subsys_request_timer" {
+		t.Fatalf("expected only the histogram, got %v", metrics)
+	}
+	histogram := metrics[0].GetMetric()[0].GetHistogram()
+	if histogram.GetSampleCount() != 4 || histogram.GetSampleSum() != 0.058 {
+		t.Fatalf("Expected: count 4 and sum 0.058, actual: count %v and sum %v", histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+	buckets := map[float64]uint64{}
+	for _, bucket := range histogram.GetBucket() {
+		buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+	}
+	expected := map[float64]uint64{0.001: 1, 0.005: 3, 0.01: 3, 0.1: 4}
+	if !reflect.DeepEqual(buckets, expected) {
+		t.Fatalf("Expected: %v, actual: %v", expected, buckets)
+	}
+}
+
+func TestDurationHistogramNeedsSample(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		WithTimerMode(ModeDurationHistogram)
+	metricsRegistry.Register("request", metrics.NewTimer())
+
+	if err := pClient.UpdatePrometheusMetricsOnce(); err == nil {
+		t.Fatalf("timer without sample wasn't reported")
+	}
+}
+
+func TestDurationHistogramFullSample(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTimerMode(ModeDurationHistogram).
+		WithTimerUnit(time.Second).
+		WithTimerBuckets([]float64{0.001, 0.01})
+	timer := NewSampledTimer(metrics.NewUniformSample(10))
+	metricsRegistry.Register("request", timer)
+	for i := 0; i < 100; i++ {
+		timer.Update(5 * time.Millisecond)
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	metrics, err := prometheusRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	histogram := metrics[0].GetMetric()[0].GetHistogram()
+	if histogram.GetSampleCount() != 10 || histogram.GetSampleSum() != 0.05 {
+		t.Fatalf("Expected: count 10 and sum 0.05, actual: count %v and sum %v", histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+	if last := histogram.GetBucket()[1]; last.GetCumulativeCount() != histogram.GetSampleCount() {
+		t.Fatalf("buckets don't add up to the count: %v", histogram.GetBucket())
+	}
+}